@@ -0,0 +1,53 @@
+/*
+   piawgcli
+   Copyright (C) 2021  Derek Battams <derek@battams.ca>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+// exit codes, from sysexits.h, telling wrappers why a command failed so they can decide whether
+// to retry, fail over or page someone; keep the README's list in sync
+const (
+	exitFailure    = 1  // anything not listed below
+	exitServerList = 65 // EX_DATAERR: the server list can't be parsed or, offline, isn't cached
+	exitRegion     = 68 // EX_NOHOST: the region is unknown or offline
+	exitAddKey     = 69 // EX_UNAVAILABLE: the region's wg server refused to register the key
+	exitNetwork    = 75 // EX_TEMPFAIL: PIA couldn't be reached or gave an unusable answer
+	exitAuth       = 77 // EX_NOPERM: PIA rejected the credentials
+)
+
+// exitCode returns the exit code for a command that failed with err
+func exitCode(err error) int {
+	switch {
+	case errors.As(err, &piaclient.AuthError{}):
+		return exitAuth
+	case errors.As(err, &piaclient.UnknownRegionError{}):
+		return exitRegion
+	case errors.As(err, &piaclient.ServerListError{}):
+		return exitServerList
+	case errors.As(err, &piaclient.AddKeyError{}):
+		return exitAddKey
+	case errors.As(err, &piaclient.NetworkError{}):
+		return exitNetwork
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,44 @@
+/*
+   piawgcli
+   Copyright (C) 2021  Derek Battams <derek@battams.ca>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{errors.New("boom"), 1},
+		{piaclient.ServerListError{Msg: "offline mode: no cached server list available"}, 65},
+		{fmt.Errorf("%w; use --pia-region-id", piaclient.UnknownRegionError{Id: "nowhere"}), 68},
+		{piaclient.AddKeyError{Region: "ca_toronto", Status: "ERROR"}, 69},
+		{piaclient.NetworkError{Op: "addKey", Err: errors.New("timeout")}, 75},
+		{fmt.Errorf("rotate: %w", piaclient.AuthError{}), 77},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.code, exitCode(tt.err), "%v", tt.err)
+	}
+}
@@ -18,40 +18,101 @@
 package main
 
 import (
-	"flag"
-	"fmt"
+	"context"
+	"io"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"gitlab.com/ddb_db/piawgcli/internal/actions"
 	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/config"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
 	"k8s.io/klog/v2"
 )
 
-var cli struct {
-	Debug        uint8                   `help:"log verbosity; higher=more log output" default:"0"`
-	LogFile      string                  `help:"log output to file instead of stdout" placeholder:"FILE"`
-	ServerList   string                  `hidden help:"PIA server list source" default:"https://serverlist.piaservers.net/vpninfo/servers/v4"`
-	ShowRegions  actions.ShowRegionsCmd  `cmd help:"show available regions"`
-	CreateConfig actions.CreateConfigCmd `cmd help:"create a PIA WireGuard configuration"`
+type cliFlags struct {
+	Debug          uint8                     `help:"log verbosity; higher=more log output" default:"0"`
+	LogFile        string                    `help:"log output to file instead of stdout" placeholder:"FILE"`
+	LogFormat      string                    `help:"log as klog's usual text or as json lines" enum:"text,json" default:"text"`
+	ServerList     string                    `hidden help:"PIA server list source" default:"https://serverlist.piaservers.net/vpninfo/servers/v4"`
+	CacheDir       string                    `help:"directory to cache the PIA server list in; defaults to the user's cache dir" placeholder:"DIR"`
+	CacheTtl       time.Duration             `help:"how long to use the cached PIA server list before checking for a newer one" default:"1h"`
+	HttpTimeout    time.Duration             `help:"how long a request to PIA may take before it's abandoned" default:"30s"`
+	Retries        uint8                     `help:"how many times to retry fetching the server list, a token or registering a key when PIA can't be reached, times out or fails internally" default:"2"`
+	Proxy          *url.URL                  `help:"send requests to PIA through this http://, https:// or socks5:// proxy; defaults to HTTPS_PROXY" placeholder:"URL"`
+	ConfigFile     string                    `help:"config file to read profiles from; defaults to piawgcli/config.yaml in the user's config dir" env:"PIAWGCLI_CONFIG" placeholder:"FILE"`
+	Profile        string                    `help:"profile to take flag values from; defaults to the config file's default-profile" env:"PIAWGCLI_PROFILE" placeholder:"NAME"`
+	ShowRegions    actions.ShowRegionsCmd    `cmd help:"show available regions"`
+	CreateConfig   actions.CreateConfigCmd   `cmd help:"create a PIA WireGuard configuration"`
+	PortForward    actions.PortForwardCmd    `cmd help:"forward a port over an established PIA WireGuard tunnel and keep it bound"`
+	Up             actions.UpCmd             `cmd help:"bring up a PIA WireGuard tunnel on a wg device without wg-quick (linux only; needs root)"`
+	Refresh        actions.RefreshCmd        `cmd help:"re-register a running wg device's key with PIA and swap its peer in place (linux only; needs root)"`
+	Daemon         actions.DaemonCmd         `cmd help:"bring up a PIA WireGuard tunnel and keep it alive, re-registering it when the session dies (linux only; needs root)"`
+	Rotate         actions.RotateCmd         `cmd help:"rotate to a new wg key pair, and optionally region, on a schedule"`
+	Status         actions.StatusCmd         `cmd help:"show the wg devices on this host and the PIA regions they're connected to"`
+	Ctl            actions.CtlCmd            `cmd help:"control a running daemon through its control socket"`
+	Down           actions.DownCmd           `cmd help:"remove a wg device brought up by the up command"`
+	InstallService actions.InstallServiceCmd `cmd help:"install systemd units that run the daemon, or refresh a device on a timer"`
+}
+
+var cli cliFlags
+
+// BeforeResolve loads the selected profile so it can fill in the flags not given on the command line
+func (c *cliFlags) BeforeResolve(ctx *kong.Context) error {
+	r, err := config.NewResolver(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(r)
+	return nil
+}
+
+// Validate checks the global flags kong can't
+func (c *cliFlags) Validate() error {
+	if c.Proxy != nil {
+		return piaclient.ValidateProxy(c.Proxy)
+	}
+	return nil
 }
 
 func main() {
 	ctx := kong.Parse(&cli)
-	klog.InitFlags(nil)
-	flag.Set("v", fmt.Sprintf("%d", cli.Debug))
+	var logOut io.Writer = os.Stderr
 	if len(cli.LogFile) > 0 {
 		logFile := prepLogFile()
 		defer logFile.Close()
-		flag.Set("logtostderr", "false")
-		flag.Set("log_file", cli.LogFile)
+		logOut = logFile
 	}
+	logging.Init(logOut, int(cli.Debug), cli.LogFormat)
 	defer klog.Flush()
-	flag.Parse()
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cacheDir := cli.CacheDir
+	if len(cacheDir) == 0 {
+		cacheDir = piaclient.DefaultCacheDir()
+	}
 	err := ctx.Run(&appstate.State{
 		Debug:      uint8(cli.Debug),
-		ServerList: cli.ServerList})
-	ctx.FatalIfErrorf(err)
+		ServerList: cli.ServerList,
+		PiaOptions: piaclient.Options{
+			CacheDir: cacheDir,
+			CacheTtl: cli.CacheTtl,
+			Timeout:  cli.HttpTimeout,
+			Retries:  int(cli.Retries),
+			Proxy:    cli.Proxy,
+			Context:  sigCtx,
+		},
+		Context: sigCtx})
+	if err != nil {
+		ctx.Errorf("%s", err)
+		klog.Flush()
+		os.Exit(exitCode(err))
+	}
 }
 
 func prepLogFile() *os.File {
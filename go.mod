@@ -4,10 +4,15 @@ go 1.16
 
 require (
 	github.com/alecthomas/kong v0.2.16
+	github.com/go-logr/logr v0.4.0
 	github.com/go-resty/resty/v2 v2.6.0
-	github.com/jamesrr39/semaphore v0.0.0-20180521202200-0d5ddc396086
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.7.0
+	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/crypto v0.0.0-20210503195802-e9a32991a82e
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20210506160403-92e472f520a5
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/klog/v2 v2.8.0
 )
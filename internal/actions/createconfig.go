@@ -18,68 +18,239 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package actions
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 
 	_ "embed"
 
 	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
 	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
-	"k8s.io/klog/v2"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/workpool"
 )
 
 type CreateConfigCmd struct {
-	PiaId        string `required help:"PIA user id" placeholder:"ID"`
-	PiaPassword  string `required help:"PIA password" placeholder:"PWD"`
-	PiaRegionId  string `required help:"PIA region id to connect to; use show-regions command to get the region id" placeholder:"ID"`
-	IgnorePiaDns bool   `help:"Do not set DNS servers to PIA servers in generated configuration"`
-	Output       string `help:"write wg config to file instead of stdout" placeholder:"FILE"`
+	PiaId        string   `required help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword  string   `required help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId  string   `help:"PIA region id to connect to; use show-regions command to get the region id, or auto for the region with the lowest latency" placeholder:"ID" xor:"region"`
+	Regions      []string `help:"create a config for each of these regions" placeholder:"ID,..." xor:"region"`
+	AllMatching  string   `help:"create a config for each region whose name or id contains SEARCH" placeholder:"SEARCH" xor:"region"`
+	AutoRegion   string   `help:"with --pia-region-id auto, only consider the regions whose name or id contains SEARCH" placeholder:"SEARCH"`
+	IgnorePiaDns bool     `help:"Do not set DNS servers to PIA servers in generated configuration"`
+	AllowedIps   []string `help:"send only these cidrs through the tunnel (split tunnelling) instead of all traffic" default:"0.0.0.0/0" placeholder:"CIDR,..."`
+	KillSwitch   bool     `help:"add wg-quick rules that reject traffic that doesn't go through the tunnel while it's up; needs iptables"`
+	Output       string   `help:"write wg config to file instead of stdout; for many regions, the pattern of the files' names (default: pia-{{.PiaRegion.Id}}.conf)" placeholder:"FILE"`
+	Parallel     uint8    `help:"max number of regions to register with at once when creating configs for many regions" default:"4"`
+
+	Mode           string `help:"file mode of written configs" default:"0600" placeholder:"MODE"`
+	Owner          string `help:"user to give written configs to" placeholder:"USER"`
+	Group          string `help:"group to give written configs to" placeholder:"GROUP"`
+	Backup         bool   `help:"keep the config being replaced as FILE.bak" default:"1" negatable`
+	FollowSymlinks bool   `help:"when the output is a symlink, write to its target instead of failing"`
 }
 
 //go:embed assets/wg.conf.tmpl
 var wgConfTmpl string
 
-// TODO break this down (verify tmpl output, etc)
+// defaultOutputPattern names the files written when creating configs for many regions
+const defaultOutputPattern = "pia-{{.PiaRegion.Id}}.conf"
+
 func (cmd *CreateConfigCmd) Run(state *appstate.State) error {
-	pia := piaclient.New(state.ServerList)
-	piaInterface, err := pia.CreateTunnel(cmd.PiaId, cmd.PiaPassword, cmd.PiaRegionId)
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	if len(cmd.Regions) > 0 || len(cmd.AllMatching) > 0 {
+		return cmd.runBatch(state, pia)
+	}
+	if len(cmd.PiaRegionId) == 0 {
+		return fmt.Errorf("one of --pia-region-id, --regions or --all-matching is required")
+	}
+	opts, err := cmd.fileOptions()
 	if err != nil {
 		return err
 	}
-	if cmd.IgnorePiaDns {
-		klog.V(4).Info("ignoring PIA DNS servers")
-		piaInterface.DnsServers = nil
+	if _, err = parseAllowedIps(cmd.AllowedIps); err != nil {
+		return err
 	}
-
-	var output *os.File
-	if len(cmd.Output) > 0 {
-		klog.V(4).Infof("writing config to %s", cmd.Output)
-		output, err = os.Create(cmd.Output)
+	regionId, err := pickRegion(state.Context, pia, cmd.PiaRegionId, cmd.AutoRegion)
+	if err != nil {
+		return err
+	}
+	piaInterface, err := pia.CreateTunnel(cmd.PiaId, cmd.PiaPassword, regionId)
+	if err != nil {
+		return err
+	}
+	result, err := cmd.config(piaInterface)
+	if err != nil {
+		return err
+	}
+	if len(cmd.Output) == 0 {
+		log.V(4).Info("writing config to stdout", logging.KeyRegion, piaInterface.PiaRegion.Id)
+		_, err = os.Stdout.WriteString(result)
 		if err != nil {
-			return err
+			return fmt.Errorf("io error writing output: %w", err)
 		}
-		defer output.Close()
-	} else {
-		klog.V(4).Info("writing config to stdout")
-		output = os.Stdout
+		return nil
 	}
+	return writeConfigFile(cmd.Output, result, opts)
+}
 
-	var result string
-	result, err = processTemplate(wgConfTmpl, piaInterface)
+// config returns the wg config of the given tunnel
+func (cmd *CreateConfigCmd) config(piaInterface piaclient.PiaInterface) (string, error) {
+	if cmd.IgnorePiaDns {
+		log.V(4).Info("ignoring PIA DNS servers", logging.KeyRegion, piaInterface.PiaRegion.Id)
+		piaInterface.DnsServers = nil
+	}
+	allowed, err := parseAllowedIps(cmd.AllowedIps)
+	if err != nil {
+		return "", err
+	}
+	result, err := processTemplate(wgConfTmpl, newWgConfig(piaInterface, allowed, cmd.KillSwitch))
 	if err != nil {
-		return fmt.Errorf("template processing failed: %w", err)
+		return "", fmt.Errorf("template processing failed: %w", err)
 	}
+	return result, nil
+}
+
+// fileOptions returns how configs are written to files
+func (cmd *CreateConfigCmd) fileOptions() (secretFileOptions, error) {
+	return configFileOptions(cmd.Mode, cmd.Owner, cmd.Group, cmd.Backup, cmd.FollowSymlinks)
+}
 
-	_, err = output.WriteString(result)
+// configFileOptions returns how configs are written to files given the flags of the command writing them
+func configFileOptions(mode string, owner string, group string, backup bool, followSymlinks bool) (secretFileOptions, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
 	if err != nil {
-		return fmt.Errorf("io error writing output: %w", err)
+		return secretFileOptions{}, fmt.Errorf("invalid mode: %s", mode)
 	}
+	return secretFileOptions{
+		perm:           os.FileMode(perm),
+		owner:          owner,
+		group:          group,
+		backup:         backup,
+		followSymlinks: followSymlinks,
+	}, nil
+}
+
+func writeConfigFile(path string, config string, opts secretFileOptions) error {
+	log.V(4).Info("writing config", "path", path)
+	return writeSecretFile(path, []byte(config), opts)
+}
 
+// batchResult is the outcome of creating the config for one region of a batch
+type batchResult struct {
+	region string
+	path   string
+}
+
+// runBatch creates a config for each of many regions, authenticating once and then registering
+// with the regions in parallel; a region that fails doesn't stop the others
+func (cmd *CreateConfigCmd) runBatch(state *appstate.State, pia piaclient.PiaClient) error {
+	pattern := cmd.Output
+	if len(pattern) == 0 {
+		pattern = defaultOutputPattern
+	}
+	if !strings.Contains(pattern, "{{") {
+		return fmt.Errorf("--output must be a pattern, i.e. %s, when creating configs for many regions", defaultOutputPattern)
+	}
+	opts, err := cmd.fileOptions()
+	if err != nil {
+		return err
+	}
+	if _, err = parseAllowedIps(cmd.AllowedIps); err != nil {
+		return err
+	}
+	regions, err := cmd.batchRegions(pia)
+	if err != nil {
+		return err
+	}
+	authToken, err := pia.Authenticate(cmd.PiaId, cmd.PiaPassword, regions[0])
+	if err != nil {
+		return err
+	}
+	var lock sync.Mutex
+	written := map[string]string{}
+	jobs := make([]workpool.Job, len(regions))
+	for i, id := range regions {
+		id := id
+		jobs[i] = func(ctx context.Context) (interface{}, error) {
+			iface, err := pia.CreateTunnelWithToken(authToken, id)
+			if err != nil {
+				return nil, err
+			}
+			path, err := processTemplate(pattern, iface)
+			if err != nil {
+				return nil, fmt.Errorf("output pattern processing failed: %w", err)
+			}
+			lock.Lock()
+			other, dup := written[path]
+			written[path] = id
+			lock.Unlock()
+			if dup {
+				return nil, fmt.Errorf("%s was already written for %s", path, other)
+			}
+			config, err := cmd.config(iface)
+			if err != nil {
+				return nil, err
+			}
+			if err = writeConfigFile(path, config, opts); err != nil {
+				return nil, err
+			}
+			return batchResult{id, path}, nil
+		}
+	}
+	ctx := state.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	failed := 0
+	fmt.Printf("%-24s %s\n", "REGION", "RESULT")
+	fmt.Printf("%s\n", strings.Repeat("=", 60))
+	for r := range workpool.New(int(cmd.Parallel)).Run(ctx, jobs) {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("%-24s FAILED: %v\n", regions[r.Index], r.Err)
+			continue
+		}
+		fmt.Printf("%-24s %s\n", regions[r.Index], r.Value.(batchResult).path)
+	}
+	fmt.Printf("\n%d succeeded, %d failed\n", len(regions)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d regions failed", failed, len(regions))
+	}
 	return nil
 }
 
+// batchRegions returns the ids of the regions to create configs for
+func (cmd *CreateConfigCmd) batchRegions(pia piaclient.PiaClient) ([]string, error) {
+	all, err := pia.GetRegions()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if len(cmd.Regions) > 0 {
+		for _, id := range cmd.Regions {
+			if _, err := findRegion(all, id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	for _, r := range matchingRegions(all, cmd.AllMatching) {
+		ids = append(ids, r.Id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no regions match %s", cmd.AllMatching)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
 func processTemplate(tmplSource string, bindings interface{}) (string, error) {
 	tmpl, err := template.New("wgconf").
 		Funcs(template.FuncMap{"join": strings.Join}).
@@ -18,10 +18,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package actions
 
 import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
 	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
 )
 
@@ -58,9 +63,112 @@ PersistentKeepalive = 25
 		},
 		CreatedOn: "10",
 	}
-	result, err := processTemplate(wgConfTmpl, iface)
+	result, err := processTemplate(wgConfTmpl, newWgConfig(iface, nil, false))
 	if err != nil {
 		t.Errorf("unexpected error processing template: %s", err.Error())
 	}
 	require.Equal(t, expected, strings.Trim(strings.ReplaceAll(result, "\r", ""), "\r\n"))
 }
+
+func TestTemplateSplitTunnelKillSwitch(t *testing.T) {
+	iface := piaclient.PiaInterface{
+		ServerEndpoint:  "192.0.2.1",
+		ServerVirtualIp: "10.0.0.1",
+		ClientIp:        "10.0.0.2",
+		DnsServers:      []string{"10.0.0.243"},
+		PiaRegion:       piaclient.PiaRegion{Id: "ca_toronto"},
+	}
+	allowed, err := parseAllowedIps([]string{"198.51.100.0/24", "203.0.113.0/24"})
+	require.NoError(t, err)
+	config, err := processTemplate(wgConfTmpl, newWgConfig(iface, allowed, true))
+	require.NoError(t, err)
+	require.Contains(t, config, "Address = 10.0.0.2/32\n"+
+		"PostUp = iptables -I OUTPUT ! -o %i ! -d 192.0.2.1 -m addrtype ! --dst-type LOCAL -j REJECT\n"+
+		"PreDown = iptables -D OUTPUT ! -o %i ! -d 192.0.2.1 -m addrtype ! --dst-type LOCAL -j REJECT\n"+
+		"DNS = 10.0.0.243\n")
+	require.Contains(t, config, "AllowedIPs = 198.51.100.0/24, 203.0.113.0/24, 10.0.0.1/32, 10.0.0.243/32\n")
+
+	routed, killSwitch := parseWgConfigRouting(config)
+	require.True(t, killSwitch)
+	require.Equal(t, allowed, routed)
+
+	_, err = parseAllowedIps([]string{"198.51.100.0"})
+	require.Error(t, err)
+}
+
+// batchPia registers tunnels with every region but ca_montreal
+type batchPia struct {
+	piaclient.PiaClient
+	lock   sync.Mutex
+	auths  int
+	tokens []string
+}
+
+func (p *batchPia) GetRegions() (piaclient.PiaRegions, error) {
+	return piaclient.PiaRegions{Regions: []piaclient.PiaRegion{
+		{Id: "ca_toronto", Name: "CA Toronto"},
+		{Id: "ca_montreal", Name: "CA Montreal"},
+		{Id: "ca_ontario", Name: "CA Ontario"},
+		{Id: "de-frankfurt", Name: "DE Frankfurt"},
+	}}, nil
+}
+
+func (p *batchPia) Authenticate(id string, pwd string, regionId string) (string, error) {
+	p.auths++
+	return "token", nil
+}
+
+func (p *batchPia) CreateTunnelWithToken(token string, regionId string) (piaclient.PiaInterface, error) {
+	p.lock.Lock()
+	p.tokens = append(p.tokens, token)
+	p.lock.Unlock()
+	if regionId == "ca_montreal" {
+		return piaclient.PiaInterface{}, errors.New("addKey failed")
+	}
+	return piaclient.PiaInterface{
+		ServerEndpoint:   "192.0.2.1",
+		ClientPrivateKey: "key-" + regionId,
+		PiaRegion:        piaclient.PiaRegion{Id: regionId},
+	}, nil
+}
+
+func TestCreateConfigBatch(t *testing.T) {
+	dir := t.TempDir()
+	pia := &batchPia{}
+	cmd := &CreateConfigCmd{
+		AllMatching: "ca ",
+		Output:      filepath.Join(dir, "pia-{{.PiaRegion.Id}}.conf"),
+		Parallel:    2,
+		Mode:        "0600",
+	}
+	err := cmd.runBatch(&appstate.State{}, pia)
+	require.EqualError(t, err, "1 of 3 regions failed")
+	require.Equal(t, 1, pia.auths)
+	require.Equal(t, []string{"token", "token", "token"}, pia.tokens)
+	for _, id := range []string{"ca_ontario", "ca_toronto"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "pia-"+id+".conf"))
+		require.NoError(t, err)
+		require.Contains(t, string(data), "PrivateKey = key-"+id)
+	}
+	require.NoFileExists(t, filepath.Join(dir, "pia-ca_montreal.conf"))
+}
+
+func TestCreateConfigBatchRegions(t *testing.T) {
+	cmd := &CreateConfigCmd{Regions: []string{"de-frankfurt", "ca_toronto"}}
+	regions, err := cmd.batchRegions(&batchPia{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"de-frankfurt", "ca_toronto"}, regions)
+
+	cmd.Regions = []string{"uk-london"}
+	_, err = cmd.batchRegions(&batchPia{})
+	require.Error(t, err)
+
+	cmd = &CreateConfigCmd{AllMatching: "nowhere"}
+	_, err = cmd.batchRegions(&batchPia{})
+	require.Error(t, err)
+}
+
+func TestCreateConfigBatchNeedsPattern(t *testing.T) {
+	cmd := &CreateConfigCmd{Regions: []string{"ca_toronto", "ca_ontario"}, Output: "pia.conf"}
+	require.Error(t, cmd.runBatch(&appstate.State{}, &batchPia{}))
+}
@@ -0,0 +1,118 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdos "os"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/control"
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+)
+
+type CtlCmd struct {
+	Socket string `help:"control socket of the daemon" default:"/run/piawgcli.sock" placeholder:"PATH"`
+	Json   bool   `help:"print the daemon's responses as json"`
+
+	Status       CtlStatusCmd       `cmd help:"show the daemon's tunnel"`
+	Reconnect    CtlReconnectCmd    `cmd help:"register a new tunnel with the current region and apply it"`
+	SwitchRegion CtlSwitchRegionCmd `cmd help:"move the daemon to another region; it's preferred over the others until the next switch"`
+	RotateKey    CtlRotateKeyCmd    `cmd help:"rotate to a new wg key pair now"`
+	Port         CtlPortCmd         `cmd help:"show the port the daemon is forwarding"`
+}
+
+type CtlStatusCmd struct{}
+
+type CtlReconnectCmd struct{}
+
+type CtlSwitchRegionCmd struct {
+	RegionId string `arg help:"id of the region to switch to"`
+}
+
+type CtlRotateKeyCmd struct{}
+
+type CtlPortCmd struct{}
+
+func (cmd *CtlStatusCmd) Run(ctl *CtlCmd, state *appstate.State) error {
+	return ctl.printStatus(control.NewClient(ctl.Socket).Status())
+}
+
+func (cmd *CtlReconnectCmd) Run(ctl *CtlCmd, state *appstate.State) error {
+	return ctl.printStatus(control.NewClient(ctl.Socket).Reconnect())
+}
+
+func (cmd *CtlSwitchRegionCmd) Run(ctl *CtlCmd, state *appstate.State) error {
+	return ctl.printStatus(control.NewClient(ctl.Socket).SwitchRegion(cmd.RegionId))
+}
+
+func (cmd *CtlRotateKeyCmd) Run(ctl *CtlCmd, state *appstate.State) error {
+	return ctl.printStatus(control.NewClient(ctl.Socket).RotateKey())
+}
+
+func (cmd *CtlPortCmd) Run(ctl *CtlCmd, state *appstate.State) error {
+	port, err := control.NewClient(ctl.Socket).Port()
+	if err != nil {
+		return err
+	}
+	if ctl.Json {
+		return printJson(stdos.Stdout, port)
+	}
+	fmt.Printf("%d (expires %s)\n", port.Port, port.ExpiresAt.Local().Format(time.UnixDate))
+	return nil
+}
+
+func (ctl *CtlCmd) printStatus(status monitor.Status, err error) error {
+	if err != nil {
+		return err
+	}
+	if ctl.Json {
+		return printJson(stdos.Stdout, status)
+	}
+	writeStatus(stdos.Stdout, status, time.Now())
+	return nil
+}
+
+func writeStatus(out io.Writer, status monitor.Status, now time.Time) {
+	if !status.Connected {
+		fmt.Fprintf(out, "%s: not connected (%d failed attempts)\n", status.Interface, status.Failures)
+		return
+	}
+	fmt.Fprintf(out, "%s: connected to %s\n", status.Interface, status.Region)
+	fmt.Fprintf(out, "  endpoint:       %s\n", status.ServerEndpoint)
+	fmt.Fprintf(out, "  client ip:      %s\n", status.ClientIp)
+	fmt.Fprintf(out, "  public key:     %s\n", status.ClientPublicKey)
+	fmt.Fprintf(out, "  last handshake: %s\n", handshakeAge(status.LastHandshake, now))
+	fmt.Fprintf(out, "  transfer:       %d B received, %d B sent\n", status.ReceiveBytes, status.TransmitBytes)
+}
+
+func handshakeAge(last time.Time, now time.Time) string {
+	if last.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", now.Sub(last).Truncate(time.Second))
+}
+
+func printJson(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,50 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+)
+
+func TestWriteStatus(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	writeStatus(&out, monitor.Status{Interface: "pia", Failures: 2}, now)
+	require.Equal(t, "pia: not connected (2 failed attempts)\n", out.String())
+
+	out.Reset()
+	writeStatus(&out, monitor.Status{
+		Interface:       "pia",
+		Connected:       true,
+		Region:          "ca_toronto",
+		ServerEndpoint:  "192.0.2.1:1337",
+		ClientIp:        "10.1.2.3",
+		ClientPublicKey: "pubkey",
+		LastHandshake:   now.Add(-90 * time.Second),
+		ReceiveBytes:    100,
+		TransmitBytes:   50,
+	}, now)
+	require.Contains(t, out.String(), "pia: connected to ca_toronto\n")
+	require.Contains(t, out.String(), "last handshake: 1m30s ago\n")
+	require.Contains(t, out.String(), "transfer:       100 B received, 50 B sent\n")
+}
@@ -0,0 +1,352 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	stdos "os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/control"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/metrics"
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/rotation"
+	"gitlab.com/ddb_db/piawgcli/internal/systemd"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+)
+
+// vipApiPort is the port of the PIA api served on a wg server's virtual ip
+const vipApiPort = 19999
+
+type DaemonCmd struct {
+	Interface        string        `help:"name of the wg device to manage" default:"pia" placeholder:"NAME"`
+	PiaId            string        `required help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword      string        `required help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId      string        `required help:"PIA region id to connect to; use show-regions command to get the region id, or auto for the region with the lowest latency at startup" placeholder:"ID"`
+	AutoRegion       string        `help:"with --pia-region-id auto, only consider the regions whose name or id contains SEARCH" placeholder:"SEARCH"`
+	IgnorePiaDns     bool          `help:"do not set DNS servers to PIA servers"`
+	AllowedIps       []string      `help:"send only these cidrs through the tunnel (split tunnelling) instead of all traffic" default:"0.0.0.0/0" placeholder:"CIDR,..."`
+	NoRoutes         bool          `help:"do not route the allowed ips through the tunnel; the server virtual ip still is"`
+	KillSwitch       bool          `help:"reject traffic that doesn't go through the tunnel, even after the daemon stops, until it's taken down with the down command; needs iptables"`
+	Interval         time.Duration `help:"how often to check the session" default:"30s"`
+	HandshakeTimeout time.Duration `help:"consider the session stale when the last handshake is older than this; wg re-handshakes every 2m while traffic flows" default:"3m"`
+	Probe            string        `help:"how to check a stale session: icmp ping or tcp connect to the server's virtual ip" enum:"icmp,tcp" default:"icmp"`
+	PingTimeout      time.Duration `help:"max time to spend probing the server" default:"5s"`
+	MinBackoff       time.Duration `help:"wait this long before retrying a failed re-registration; doubled after each failure" default:"10s"`
+	MaxBackoff       time.Duration `help:"longest wait between re-registration attempts" default:"5m"`
+
+	FailoverRegions   []string      `help:"regions to fail over to, in order of preference, when the current region keeps failing" placeholder:"ID,..."`
+	FailoverByLatency bool          `help:"order the failover regions by latency at startup; all regions are candidates when --failover-regions is not given"`
+	FailoverAfter     int           `help:"fail over after this many consecutive failures of a region" default:"3"`
+	FailbackAfter     time.Duration `help:"avoid a failed region for this long before failing back to it" default:"30m"`
+
+	RotateSchedule  string   `help:"also rotate to a new key on this cron spec (i.e. '0 */6 * * *') or descriptor (i.e. @daily)" placeholder:"SPEC"`
+	RotateRegions   []string `help:"cycle through these regions, one per rotation, instead of staying in the current region" placeholder:"ID,..."`
+	RotationHistory string   `help:"where rotations are recorded; defaults to the cache dir" placeholder:"FILE"`
+
+	MetricsListen string `help:"serve prometheus metrics on this address, i.e. :9586" placeholder:"ADDR"`
+
+	ControlSocket      string `help:"unix socket to serve the control api on; see the ctl command (empty to disable)" default:"/run/piawgcli.sock" placeholder:"PATH"`
+	ControlSocketMode  string `help:"file mode of the control socket; anyone who can connect to it can control the daemon" default:"0660" placeholder:"MODE"`
+	ControlSocketGroup string `help:"group to give the control socket to" placeholder:"GROUP"`
+
+	PortForward  bool   `help:"forward a port over the tunnel, re-requesting it whenever the tunnel changes (regions that support it only)"`
+	PortFile     string `help:"with --port-forward, write the forwarded port to this file whenever it changes" placeholder:"FILE"`
+	OnPortChange string `help:"with --port-forward, command to run whenever the forwarded port changes; the port is in the PIA_PORT env var" placeholder:"CMD"`
+}
+
+func (cmd *DaemonCmd) Run(state *appstate.State) error {
+	allowed, err := parseAllowedIps(cmd.AllowedIps)
+	if err != nil {
+		return err
+	}
+	mgr, err := wgdevice.New()
+	if err != nil {
+		return err
+	}
+	defer mgr.Close()
+	var pinger os.Pinger
+	if cmd.Probe == "tcp" {
+		pinger = os.NewTcpPinger(vipApiPort, cmd.PingTimeout)
+	} else {
+		pinger = os.NewPinger(cmd.PingTimeout)
+	}
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	regions, err := cmd.regions(state.Context, pia)
+	if err != nil {
+		return err
+	}
+	log.V(1).Info("region preference", "regions", strings.Join(regions, ","))
+	cfg := monitor.Config{
+		Interface:   cmd.Interface,
+		PiaId:       cmd.PiaId,
+		PiaPassword: cmd.PiaPassword,
+		Regions:     regions,
+		Device: wgdevice.Options{
+			Routes:     !cmd.NoRoutes,
+			Dns:        !cmd.IgnorePiaDns,
+			AllowedIps: allowed,
+			KillSwitch: cmd.KillSwitch,
+		},
+		Interval:         cmd.Interval,
+		HandshakeTimeout: cmd.HandshakeTimeout,
+		PingSamples:      3,
+		MinBackoff:       cmd.MinBackoff,
+		MaxBackoff:       cmd.MaxBackoff,
+		FailoverAfter:    cmd.FailoverAfter,
+		FailbackAfter:    cmd.FailbackAfter,
+	}
+	if len(cmd.MetricsListen) > 0 {
+		metrics.WatchDevice(cmd.Interface, mgr.Device)
+		if err = metrics.Serve(state.Context, cmd.MetricsListen); err != nil {
+			return err
+		}
+	}
+	ctl := &daemonControl{}
+	if cmd.PortForward {
+		ctl.forwarder = &daemonPortForward{
+			ctx: state.Context,
+			cmd: &PortForwardCmd{
+				PiaId:         cmd.PiaId,
+				PiaPassword:   cmd.PiaPassword,
+				Interval:      15 * time.Minute,
+				PortFile:      cmd.PortFile,
+				OnPortChange:  cmd.OnPortChange,
+				ExpiryWarning: 72 * time.Hour,
+			},
+			pia: pia,
+		}
+		if len(state.PiaOptions.CacheDir) > 0 {
+			ctl.forwarder.stateFile = filepath.Join(state.PiaOptions.CacheDir, "portforward.json")
+		}
+		cfg.OnConnect = ctl.forwarder.connected
+	}
+	ctl.mon = monitor.New(cfg, pia, mgr, pinger)
+	rotateCfg := rotation.Config{
+		PiaId:       cmd.PiaId,
+		PiaPassword: cmd.PiaPassword,
+		Region:      ctl.mon.Region,
+		Apply:       ctl.mon.Apply,
+		Target:      cmd.Interface,
+		History:     rotationHistory(cmd.RotationHistory, state),
+	}
+	if len(cmd.RotateRegions) > 0 {
+		rotateCfg.Region = rotation.Cycle(cmd.RotateRegions)
+	}
+	if len(cmd.RotateSchedule) > 0 {
+		if rotateCfg.Schedule, err = rotation.ParseSchedule(cmd.RotateSchedule); err != nil {
+			return err
+		}
+	}
+	ctl.rotator = rotation.New(rotateCfg, pia)
+	if rotateCfg.Schedule != nil {
+		go ctl.rotator.Run(state.Context)
+	}
+	if len(cmd.ControlSocket) > 0 {
+		mode, err := strconv.ParseUint(cmd.ControlSocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid control socket mode: %s", cmd.ControlSocketMode)
+		}
+		opts := control.SocketOptions{Mode: stdos.FileMode(mode), Group: cmd.ControlSocketGroup}
+		if err = control.Serve(state.Context, cmd.ControlSocket, opts, ctl); err != nil {
+			return err
+		}
+	}
+	go systemd.NewNotifier().Run(state.Context, cmd.Interval, systemd.Service{
+		Ready:    ctl.mon.Ready(),
+		Progress: ctl.mon.LastTick,
+		Status: func() string {
+			return serviceStatus(ctl.mon.Status(), time.Now())
+		},
+	})
+	return ctl.mon.Run(state.Context)
+}
+
+// serviceStatus describes the daemon's tunnel for systemctl status
+func serviceStatus(status monitor.Status, now time.Time) string {
+	if !status.Connected {
+		return fmt.Sprintf("not connected (%d failed attempts)", status.Failures)
+	}
+	return fmt.Sprintf("connected to %s, last handshake %s", status.Region, handshakeAge(status.LastHandshake, now))
+}
+
+// regions returns the regions to use in order of preference: the chosen region and then the
+// failover regions
+func (cmd *DaemonCmd) regions(ctx context.Context, pia piaclient.PiaClient) ([]string, error) {
+	chosen, err := pickRegion(ctx, pia, cmd.PiaRegionId, cmd.AutoRegion)
+	if err != nil {
+		return nil, err
+	}
+	failover := cmd.FailoverRegions
+	if cmd.FailoverByLatency {
+		all, err := pia.GetRegions()
+		if err != nil {
+			return nil, err
+		}
+		candidates := all.Regions
+		if len(failover) > 0 {
+			candidates = nil
+			for _, id := range failover {
+				r, err := findRegion(all, id)
+				if err != nil {
+					return nil, err
+				}
+				candidates = append(candidates, r)
+			}
+		}
+		log.V(1).Info("ranking failover regions by latency", "count", len(candidates))
+		failover = rankRegions(ctx, candidates, newPinger("icmp", os.DefaultTimeout))
+	}
+	regions := []string{chosen}
+	for _, id := range failover {
+		if id != chosen {
+			regions = append(regions, id)
+		}
+	}
+	return regions, nil
+}
+
+// rankRegions orders regions by latency, as show-regions --ping does; unreachable regions are dropped
+func rankRegions(ctx context.Context, regions []piaclient.PiaRegion, pinger os.Pinger) []string {
+	// pinging replaces the regions in place and the caller's are shared with the client's memo
+	regions = append([]piaclient.PiaRegion(nil), regions...)
+	action := showRegionsAction{
+		cmd: &ShowRegionsCmd{
+			Ping:      true,
+			SortOrder: "asc",
+			PingSort:  "avg",
+			Threads:   8,
+			Samples:   3,
+			Probe:     "icmp",
+		},
+		pinger: pinger,
+	}
+	action.pingRegions(ctx, regions)
+	action.sortRegions(regions)
+	var ranked []string
+	for _, r := range regions {
+		if r.Ping.Reachable() {
+			ranked = append(ranked, r.Id)
+		}
+	}
+	return ranked
+}
+
+// daemonControl answers control api requests for a running daemon
+type daemonControl struct {
+	mon       *monitor.Monitor
+	rotator   *rotation.Rotator
+	forwarder *daemonPortForward // nil unless forwarding a port
+}
+
+func (d *daemonControl) Status() monitor.Status {
+	return d.mon.Status()
+}
+
+func (d *daemonControl) Reconnect() error {
+	return d.mon.Reconnect()
+}
+
+func (d *daemonControl) SwitchRegion(id string) error {
+	return d.mon.SwitchRegion(id)
+}
+
+func (d *daemonControl) RotateKey() error {
+	_, err := d.rotator.Rotate()
+	return err
+}
+
+func (d *daemonControl) Port() (control.Port, bool) {
+	if d.forwarder == nil {
+		return control.Port{}, false
+	}
+	return d.forwarder.port()
+}
+
+// daemonPortForward keeps a port forwarded over whatever tunnel the daemon is currently using
+type daemonPortForward struct {
+	ctx       context.Context
+	cmd       *PortForwardCmd
+	pia       piaclient.PiaClient
+	stateFile string
+
+	lock    sync.Mutex
+	cancel  context.CancelFunc // stops forwarding over the previous tunnel
+	current piaclient.PortForward
+}
+
+// connected starts forwarding a port over a newly applied tunnel
+func (f *daemonPortForward) connected(iface piaclient.PiaInterface) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.cancel != nil {
+		f.cancel()
+	}
+	f.current = piaclient.PortForward{}
+	if !iface.PiaRegion.PortForward {
+		log.Warning("region does not support port forwarding", logging.KeyRegion, iface.PiaRegion.Id)
+		return
+	}
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(f.ctx)
+	action := &portForwardAction{
+		cmd:       f.cmd,
+		pia:       f.pia,
+		iface:     iface,
+		out:       ioutil.Discard,
+		stateFile: f.stateFile,
+		published: func(pf piaclient.PortForward) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			// a port bound over a tunnel that has since been replaced is of no use
+			if ctx.Err() == nil {
+				f.current = pf
+			}
+		},
+	}
+	go func() {
+		for {
+			err := action.run(ctx)
+			if err == nil {
+				return
+			}
+			log.Error(err, "port forwarding failed, retrying in a minute", logging.KeyRegion, iface.PiaRegion.Id)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+func (f *daemonPortForward) port() (control.Port, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return control.Port{Port: f.current.Port, ExpiresAt: f.current.ExpiresAt}, f.current.Port > 0
+}
@@ -0,0 +1,60 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+)
+
+type rankPinger struct{}
+
+// rankPinger takes as long as the host name is long; hosts named "down" never answer
+func (p rankPinger) Ping(ctx context.Context, host string, samples uint8) os.PingResult {
+	if host == "down" {
+		return os.PingResult{Sent: 1}
+	}
+	return pingMs(len(host))
+}
+
+func TestRankRegions(t *testing.T) {
+	r := []piaclient.PiaRegion{{Id: "a", Dns: "aaa"}, {Id: "b", Dns: "down"}, {Id: "c", Dns: "c"}, {Id: "d", Dns: "dd"}}
+	require.Equal(t, []string{"c", "d", "a"}, rankRegions(context.Background(), r, rankPinger{}))
+	require.Equal(t, "a", r[0].Id)
+	require.False(t, r[0].Ping.Reachable(), "caller's regions were modified")
+}
+
+func TestDaemonRegions(t *testing.T) {
+	cmd := DaemonCmd{PiaRegionId: "b", FailoverRegions: []string{"a", "b", "c"}}
+	regions, err := cmd.regions(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "a", "c"}, regions)
+}
+
+func TestServiceStatus(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, "not connected (3 failed attempts)", serviceStatus(monitor.Status{Failures: 3}, now))
+	status := monitor.Status{Connected: true, Region: "ca_toronto", LastHandshake: now.Add(-time.Minute)}
+	require.Equal(t, "connected to ca_toronto, last handshake 1m0s ago", serviceStatus(status, now))
+}
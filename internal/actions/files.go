@@ -0,0 +1,124 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic replaces the file at path with data such that readers only ever see the old or new content
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicAs(path, data, perm, -1, -1)
+}
+
+// writeFileAtomicAs is writeFileAtomic giving the file to the given owner and group; -1 leaves either unchanged
+func writeFileAtomicAs(path string, data []byte, perm os.FileMode, uid int, gid int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(perm); err == nil && (uid != -1 || gid != -1) {
+		err = tmp.Chown(uid, gid)
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// secretFileOptions control how a file holding secrets, i.e. a wg config, is written
+type secretFileOptions struct {
+	perm           os.FileMode
+	owner          string // optional; name or uid
+	group          string // optional; name or gid
+	backup         bool   // keep the file being replaced as path.bak
+	followSymlinks bool   // write to the target of a symlink rather than refusing to
+}
+
+// writeSecretFile atomically replaces the file at path with data
+func writeSecretFile(path string, data []byte, opts secretFileOptions) error {
+	uid, gid, err := lookupOwner(opts.owner, opts.group)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if !opts.followSymlinks {
+			return fmt.Errorf("%s is a symlink; use --follow-symlinks to write to its target", path)
+		}
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return err
+		}
+		info, err = os.Stat(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && opts.backup {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = writeFileAtomicAs(path+".bak", old, info.Mode().Perm()&opts.perm, uid, gid); err != nil {
+			return fmt.Errorf("unable to back up %s: %w", path, err)
+		}
+	}
+	return writeFileAtomicAs(path, data, opts.perm, uid, gid)
+}
+
+// lookupOwner returns the uid and gid of the named user and group; -1 for those not given
+func lookupOwner(owner string, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if len(owner) > 0 {
+		if id, err := strconv.Atoi(owner); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return -1, -1, err
+		}
+	}
+	if len(group) > 0 {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return -1, -1, err
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,95 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pia.conf")
+	opts := secretFileOptions{perm: 0600, backup: true}
+	require.NoError(t, writeSecretFile(path, []byte("first"), opts))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.NoFileExists(t, path+".bak")
+
+	require.NoError(t, writeSecretFile(path, []byte("second"), opts))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+	data, err = ioutil.ReadFile(path + ".bak")
+	require.NoError(t, err)
+	require.Equal(t, "first", string(data))
+
+	// no temp files are left behind
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestWriteSecretFileKeepsBackupPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pia.conf")
+	require.NoError(t, ioutil.WriteFile(path, []byte("old"), 0644))
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, writeSecretFile(path, []byte("new"), secretFileOptions{perm: 0600, backup: true}))
+	info, err := os.Stat(path + ".bak")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestWriteSecretFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.conf")
+	link := filepath.Join(dir, "pia.conf")
+	require.NoError(t, ioutil.WriteFile(target, []byte("old"), 0600))
+	require.NoError(t, os.Symlink(target, link))
+
+	err := writeSecretFile(link, []byte("new"), secretFileOptions{perm: 0600})
+	require.Error(t, err)
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(data))
+
+	require.NoError(t, writeSecretFile(link, []byte("new"), secretFileOptions{perm: 0600, followSymlinks: true}))
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	require.NotZero(t, info.Mode()&os.ModeSymlink)
+	data, err = ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("", "")
+	require.NoError(t, err)
+	require.Equal(t, -1, uid)
+	require.Equal(t, -1, gid)
+	uid, gid, err = lookupOwner("0", "0")
+	require.NoError(t, err)
+	require.Equal(t, 0, uid)
+	require.Equal(t, 0, gid)
+	_, _, err = lookupOwner("no-such-user-piawgcli", "")
+	require.Error(t, err)
+}
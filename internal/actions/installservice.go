@@ -0,0 +1,181 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	stdos "os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "embed"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+)
+
+type InstallServiceCmd struct {
+	Mode            string        `arg enum:"daemon,refresh" help:"daemon: run the daemon as a service; refresh: refresh a device brought up by the up command on a timer"`
+	Args            []string      `arg optional help:"extra options for the daemon or refresh command; give them after --"`
+	Name            string        `help:"name of the systemd units" default:"piawgcli" placeholder:"NAME"`
+	Interface       string        `help:"name of the wg device to manage" default:"pia" placeholder:"NAME"`
+	PiaId           string        `required help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword     string        `required help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId     string        `help:"PIA region id; required by the daemon, refresh keeps the device's current region without it" placeholder:"ID"`
+	Every           time.Duration `help:"with refresh, how often to refresh the device" default:"1h"`
+	Watchdog        time.Duration `help:"with daemon, have systemd restart it when it stops responding for this long (0 to disable)" default:"3m"`
+	UnitDir         string        `help:"directory to write the units to" default:"/etc/systemd/system" placeholder:"DIR"`
+	CredentialsFile string        `help:"file to write the PIA credentials to, readable by root only; defaults to /etc/piawgcli/NAME.env" placeholder:"FILE"`
+	DryRun          bool          `help:"print the files instead of writing them"`
+}
+
+//go:embed assets/systemd.service.tmpl
+var serviceTmpl string
+
+//go:embed assets/systemd.timer.tmpl
+var timerTmpl string
+
+// unitFile is a file written by install-service
+type unitFile struct {
+	path    string
+	content string
+	perm    stdos.FileMode
+	preview string // what --dry-run prints in place of content, when that holds secrets
+}
+
+type unitBindings struct {
+	Name            string
+	Description     string
+	Daemon          bool
+	WatchdogSec     int64
+	EverySec        int64
+	CredentialsFile string
+	ExecStart       string
+}
+
+func (cmd *InstallServiceCmd) Run(state *appstate.State) error {
+	exe, err := stdos.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the piawgcli executable: %w", err)
+	}
+	files, err := cmd.files(exe)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if cmd.DryRun {
+			preview := f.content
+			if len(f.preview) > 0 {
+				preview = f.preview
+			}
+			fmt.Printf("# %s\n%s\n", f.path, preview)
+			continue
+		}
+		if err = stdos.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		if err = writeFileAtomic(f.path, []byte(f.content), f.perm); err != nil {
+			return fmt.Errorf("unable to write %s: %w", f.path, err)
+		}
+		fmt.Printf("wrote %s\n", f.path)
+	}
+	if !cmd.DryRun {
+		unit := cmd.Name + ".service"
+		if cmd.Mode == "refresh" {
+			unit = cmd.Name + ".timer"
+		}
+		fmt.Printf("to start it now and at boot run: systemctl daemon-reload && systemctl enable --now %s\n", unit)
+	}
+	return nil
+}
+
+// files returns the units, and the credentials file they read, that run the given executable
+func (cmd *InstallServiceCmd) files(exe string) ([]unitFile, error) {
+	credentials := cmd.CredentialsFile
+	if len(credentials) == 0 {
+		credentials = filepath.Join("/etc/piawgcli", cmd.Name+".env")
+	}
+	args := []string{exe, cmd.Mode, "--interface", cmd.Interface}
+	if len(cmd.PiaRegionId) > 0 {
+		args = append(args, "--pia-region-id", cmd.PiaRegionId)
+	} else if cmd.Mode == "daemon" {
+		return nil, fmt.Errorf("--pia-region-id is required for the daemon")
+	}
+	// the credentials are kept out of the world readable units and the command line; the service
+	// reads PIA_ID and PIA_PASSWORD from its environment
+	execStart := strings.Join(quoteUnitArgs(args), " ")
+	if len(cmd.Args) > 0 {
+		execStart += " " + strings.Join(quoteUnitArgs(cmd.Args), " ")
+	}
+	bindings := unitBindings{
+		Name:            cmd.Name,
+		Description:     fmt.Sprintf("PIA WireGuard tunnel on %s", cmd.Interface),
+		Daemon:          cmd.Mode == "daemon",
+		WatchdogSec:     int64(cmd.Watchdog / time.Second),
+		EverySec:        int64(cmd.Every / time.Second),
+		CredentialsFile: credentials,
+		ExecStart:       execStart,
+	}
+	if !bindings.Daemon {
+		bindings.Description = fmt.Sprintf("Refresh the PIA WireGuard tunnel on %s", cmd.Interface)
+		if bindings.EverySec < 1 {
+			return nil, fmt.Errorf("--every must be at least 1s")
+		}
+	}
+	service, err := processTemplate(serviceTmpl, bindings)
+	if err != nil {
+		return nil, fmt.Errorf("service template processing failed: %w", err)
+	}
+	files := []unitFile{
+		{path: filepath.Join(cmd.UnitDir, cmd.Name+".service"), content: service, perm: 0644},
+	}
+	if !bindings.Daemon {
+		timer, err := processTemplate(timerTmpl, bindings)
+		if err != nil {
+			return nil, fmt.Errorf("timer template processing failed: %w", err)
+		}
+		files = append(files, unitFile{path: filepath.Join(cmd.UnitDir, cmd.Name+".timer"), content: timer, perm: 0644})
+	}
+	env := "PIA_ID=%s\nPIA_PASSWORD=%s\n"
+	return append(files, unitFile{
+		path:    credentials,
+		content: fmt.Sprintf(env, quoteEnvValue(cmd.PiaId), quoteEnvValue(cmd.PiaPassword)),
+		perm:    0600,
+		preview: fmt.Sprintf(env, quoteEnvValue(cmd.PiaId), quoteEnvValue("********")),
+	}), nil
+}
+
+// quoteUnitArgs quotes args for a unit's ExecStart so systemd passes them through untouched
+func quoteUnitArgs(args []string) []string {
+	specials := strings.NewReplacer("%", "%%", "$", "$$")
+	quotes := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		a = specials.Replace(a)
+		if len(a) == 0 || strings.ContainsAny(a, " \t\n\"'\\;") {
+			a = `"` + quotes.Replace(a) + `"`
+		}
+		quoted[i] = a
+	}
+	return quoted
+}
+
+// quoteEnvValue quotes a value for a systemd EnvironmentFile
+func quoteEnvValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -0,0 +1,89 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallServiceDaemon(t *testing.T) {
+	cmd := &InstallServiceCmd{
+		Mode:        "daemon",
+		Args:        []string{"--on-port-change", "echo $PIA_PORT"},
+		Name:        "piawgcli",
+		Interface:   "pia",
+		PiaId:       "p1234",
+		PiaPassword: `se"cret`,
+		PiaRegionId: "ca_toronto",
+		Watchdog:    3 * time.Minute,
+		UnitDir:     "/etc/systemd/system",
+	}
+	files, err := cmd.files("/usr/bin/piawgcli")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, "/etc/systemd/system/piawgcli.service", files[0].path)
+	require.Contains(t, files[0].content, "Type=notify\n")
+	require.Contains(t, files[0].content, "WatchdogSec=180\n")
+	require.Contains(t, files[0].content, "EnvironmentFile=/etc/piawgcli/piawgcli.env\n")
+	require.Contains(t, files[0].content, `ExecStart=/usr/bin/piawgcli daemon --interface pia --pia-region-id ca_toronto --on-port-change "echo $$PIA_PORT"`+"\n")
+	require.NotContains(t, files[0].content, "cret")
+	require.NotContains(t, files[0].content, "PIA_PASSWORD")
+	require.NotContains(t, files[0].content, "--pia-password")
+	require.Equal(t, "/etc/piawgcli/piawgcli.env", files[1].path)
+	require.Equal(t, "PIA_ID=\"p1234\"\nPIA_PASSWORD=\"se\\\"cret\"\n", files[1].content)
+	require.Equal(t, os.FileMode(0600), files[1].perm)
+	require.Equal(t, "PIA_ID=\"p1234\"\nPIA_PASSWORD=\"********\"\n", files[1].preview)
+
+	cmd.PiaRegionId = ""
+	_, err = cmd.files("/usr/bin/piawgcli")
+	require.Error(t, err)
+}
+
+func TestInstallServiceRefresh(t *testing.T) {
+	dir := t.TempDir()
+	cmd := &InstallServiceCmd{
+		Mode:            "refresh",
+		Name:            "pia-refresh",
+		Interface:       "pia",
+		PiaId:           "p1234",
+		PiaPassword:     "secret",
+		Every:           time.Hour,
+		UnitDir:         dir,
+		CredentialsFile: filepath.Join(dir, "creds", "pia.env"),
+	}
+	require.NoError(t, cmd.Run(nil))
+	service, err := ioutil.ReadFile(filepath.Join(dir, "pia-refresh.service"))
+	require.NoError(t, err)
+	require.Contains(t, string(service), "Type=oneshot\n")
+	require.NotContains(t, string(service), "[Install]")
+	require.NotContains(t, string(service), "secret")
+	require.NotContains(t, string(service), "--pia-password")
+	timer, err := ioutil.ReadFile(filepath.Join(dir, "pia-refresh.timer"))
+	require.NoError(t, err)
+	require.Contains(t, string(timer), "OnUnitActiveSec=3600\n")
+	require.Contains(t, string(timer), "Unit=pia-refresh.service\n")
+	info, err := os.Stat(cmd.CredentialsFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,115 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient/piatest"
+	"k8s.io/klog/v2"
+)
+
+// TestActionsDoNotLogSecrets runs the actions that talk to PIA without needing root at max verbosity;
+// up, refresh and daemon need a wg device so are covered by piaclient's own test of the calls they make
+func TestActionsDoNotLogSecrets(t *testing.T) {
+	for _, format := range []string{logging.FormatText, logging.FormatJson} {
+		t.Run(format, func(t *testing.T) {
+			testActionsDoNotLogSecrets(t, format)
+		})
+	}
+}
+
+func testActionsDoNotLogSecrets(t *testing.T, format string) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	var logged bytes.Buffer
+	logging.Init(&logged, 255, format)
+	defer logging.Init(&bytes.Buffer{}, 0, logging.FormatText)
+	dir := t.TempDir()
+	state := func(timeout time.Duration) *appstate.State {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		t.Cleanup(cancel)
+		return &appstate.State{
+			Debug:      255,
+			ServerList: piatest.ServerListUrl,
+			PiaOptions: piaclient.Options{CacheDir: dir, Transport: srv.Transport},
+			Context:    ctx,
+		}
+	}
+	config := filepath.Join(dir, "pia.conf")
+	secrets := []string{piatest.Password, piatest.Token, piatest.Signature}
+	keyOf := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		iface, _, err := parseWgConfig(string(data))
+		require.NoError(t, err)
+		require.NotEmpty(t, iface.ClientPrivateKey)
+		return iface.ClientPrivateKey
+	}
+
+	require.NoError(t, (&ShowRegionsCmd{}).Run(state(time.Minute)))
+	require.NoError(t, (&CreateConfigCmd{
+		PiaId:       piatest.Id,
+		PiaPassword: piatest.Password,
+		PiaRegionId: "ca_toronto",
+		Output:      config,
+		Mode:        "0600",
+	}).Run(state(time.Minute)))
+	secrets = append(secrets, keyOf("pia.conf"))
+	require.NoError(t, (&CreateConfigCmd{
+		PiaId:       piatest.Id,
+		PiaPassword: piatest.Password,
+		Regions:     []string{"ca_toronto", "us_east"},
+		Output:      filepath.Join(dir, defaultOutputPattern),
+		Parallel:    2,
+		Mode:        "0600",
+	}).Run(state(time.Minute)))
+	secrets = append(secrets, keyOf("pia-ca_toronto.conf"), keyOf("pia-us_east.conf"))
+	require.NoError(t, (&PortForwardCmd{
+		PiaId:       piatest.Id,
+		PiaPassword: piatest.Password,
+		Config:      config,
+		Interval:    time.Hour,
+		StateFile:   filepath.Join(dir, "portforward.json"),
+	}).Run(state(500*time.Millisecond)))
+	require.NoError(t, (&RotateCmd{
+		PiaId:       piatest.Id,
+		PiaPassword: piatest.Password,
+		Config:      config,
+		Once:        true,
+		HistoryFile: filepath.Join(dir, "history.json"),
+		Mode:        "0600",
+	}).Run(state(time.Minute)))
+	secrets = append(secrets, keyOf("pia.conf"))
+	klog.Flush()
+
+	out := logged.String()
+	require.Contains(t, out, "/addKey", "resty's request dump is missing")
+	for _, secret := range secrets {
+		require.NotContains(t, out, secret)
+	}
+}
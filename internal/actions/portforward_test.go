@@ -0,0 +1,232 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/portconsumer"
+)
+
+// fakePia stands in for the PIA apis; methods not overridden here panic when called
+type fakePia struct {
+	piaclient.PiaClient
+	port     uint16
+	ttl      time.Duration // how long forwarded ports last; an hour when unset
+	gets     int32
+	binds    int32
+	bindErrs int32 // number of binds to fail before succeeding
+}
+
+// GetPortForward hands out port, port+1, port+2... on successive calls
+func (f *fakePia) GetPortForward(string, string, piaclient.PiaInterface) (piaclient.PortForward, error) {
+	n := atomic.AddInt32(&f.gets, 1)
+	ttl := f.ttl
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	return piaclient.PortForward{Port: f.port + uint16(n-1), Payload: "p", Signature: "s", ExpiresAt: time.Now().Add(ttl)}, nil
+}
+
+func (f *fakePia) BindPort(piaclient.PiaInterface, piaclient.PortForward) error {
+	atomic.AddInt32(&f.binds, 1)
+	if atomic.AddInt32(&f.bindErrs, -1) >= 0 {
+		return errors.New("bind failed")
+	}
+	return nil
+}
+
+func TestPortForwardKeepAlive(t *testing.T) {
+	pia := &fakePia{port: 47047}
+	out := &strings.Builder{}
+	action := portForwardAction{
+		cmd: &PortForwardCmd{Interval: 10 * time.Millisecond},
+		pia: pia,
+		out: out,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, action.run(ctx))
+	require.Equal(t, "47047\n", out.String())
+	require.True(t, atomic.LoadInt32(&pia.binds) > 2, "port was not re-bound")
+}
+
+func TestPortForwardInitialBindFails(t *testing.T) {
+	pia := &fakePia{port: 47047, bindErrs: 1}
+	action := portForwardAction{
+		cmd: &PortForwardCmd{Interval: time.Hour},
+		pia: pia,
+		out: &strings.Builder{},
+	}
+	require.Error(t, action.run(context.Background()))
+}
+
+func TestPortForwardStateIsReused(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "pf.json")
+	iface := piaclient.PiaInterface{ServerCn: "toronto401", ServerVirtualIp: "10.0.0.1"}
+	newAction := func(pia *fakePia, out *strings.Builder) *portForwardAction {
+		return &portForwardAction{
+			cmd:       &PortForwardCmd{Interval: time.Hour},
+			pia:       pia,
+			iface:     iface,
+			out:       out,
+			stateFile: stateFile,
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	out := &strings.Builder{}
+	require.NoError(t, newAction(&fakePia{port: 1000}, out).run(ctx))
+	require.Equal(t, "1000\n", out.String())
+
+	// a restart re-binds the saved port rather than asking for a new one
+	pia := &fakePia{port: 2000}
+	out = &strings.Builder{}
+	require.NoError(t, newAction(pia, out).run(ctx))
+	require.Equal(t, "1000\n", out.String())
+	require.Equal(t, int32(0), pia.gets)
+
+	// but not when connected to a different server
+	iface.ServerCn = "toronto402"
+	out = &strings.Builder{}
+	require.NoError(t, newAction(pia, out).run(ctx))
+	require.Equal(t, "2000\n", out.String())
+}
+
+func TestPortForwardExpiredPortIsReplaced(t *testing.T) {
+	pia := &fakePia{port: 1000, ttl: -time.Minute}
+	out := &strings.Builder{}
+	action := &portForwardAction{
+		cmd: &PortForwardCmd{Interval: time.Hour},
+		pia: pia,
+		out: out,
+	}
+	action.acquire()
+	action.keepAlive(context.Background())
+	require.Equal(t, uint16(1001), action.pf.Port)
+	require.Equal(t, "1001\n", out.String())
+}
+
+func TestPortForwardHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook uses a posix shell")
+	}
+	dir := t.TempDir()
+	portFile := filepath.Join(dir, "port")
+	hookFile := filepath.Join(dir, "hook")
+	action := &portForwardAction{
+		cmd: &PortForwardCmd{
+			Interval:     time.Hour,
+			PortFile:     portFile,
+			OnPortChange: "echo $PIA_PREVIOUS_PORT $PIA_PORT > " + hookFile,
+		},
+		pia: &fakePia{port: 1000},
+		out: &strings.Builder{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	require.NoError(t, action.run(ctx))
+	data, err := ioutil.ReadFile(portFile)
+	require.NoError(t, err)
+	require.Equal(t, "1000\n", string(data))
+	data, err = ioutil.ReadFile(hookFile)
+	require.NoError(t, err)
+	require.Equal(t, "0 1000\n", string(data))
+}
+
+func TestParseWgConfig(t *testing.T) {
+	iface := piaclient.PiaInterface{
+		ServerPublicKey:  "srvkey",
+		ServerPort:       1337,
+		ServerEndpoint:   "10.1.2.3",
+		ServerVirtualIp:  "10.0.0.1",
+		ClientIp:         "10.0.0.2",
+		ClientPublicKey:  "pubkey",
+		ClientPrivateKey: "privkey",
+		DnsServers:       []string{"10.0.0.243", "10.0.0.242"},
+		PiaRegion:        piaclient.PiaRegion{Id: "ca_toronto", Name: "CA Toronto"},
+	}
+	config, err := processTemplate(wgConfTmpl, newWgConfig(iface, nil, false))
+	require.NoError(t, err)
+	parsed, regionId, err := parseWgConfig(config)
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regionId)
+	iface.PiaRegion = piaclient.PiaRegion{}
+	require.Equal(t, iface, parsed)
+
+	_, _, err = parseWgConfig("[Interface]\nPrivateKey = foo\n")
+	require.Error(t, err)
+}
+
+func TestRegionForEndpoint(t *testing.T) {
+	regions := piaclient.PiaRegions{Regions: []piaclient.PiaRegion{
+		{Id: "ca_toronto", Servers: piaclient.PiaServers{Wg: []piaclient.PiaServer{{Ip: "10.1.2.3"}}}},
+		{Id: "ca_ontario", Servers: piaclient.PiaServers{Wg: []piaclient.PiaServer{{Ip: "10.1.2.4"}, {Ip: "10.1.2.5"}}}},
+	}}
+	r, err := regionForEndpoint(regions, "10.1.2.5")
+	require.NoError(t, err)
+	require.Equal(t, "ca_ontario", r.Id)
+	_, err = regionForEndpoint(regions, "10.1.2.6")
+	require.Error(t, err)
+}
+
+type flakyConsumer struct {
+	fails int
+	ports []uint16
+}
+
+func (c *flakyConsumer) Name() string {
+	return "flaky"
+}
+
+func (c *flakyConsumer) SetPort(port uint16) error {
+	if c.fails > 0 {
+		c.fails--
+		return errors.New("connection refused")
+	}
+	c.ports = append(c.ports, port)
+	return nil
+}
+
+func TestPortForwardConsumerRetried(t *testing.T) {
+	consumer := &flakyConsumer{fails: 1}
+	action := &portForwardAction{
+		cmd:       &PortForwardCmd{Interval: time.Hour},
+		pia:       &fakePia{port: 1000},
+		out:       &strings.Builder{},
+		consumers: []portconsumer.PortConsumer{consumer},
+	}
+	require.NoError(t, action.acquire())
+	action.portChanged(context.Background(), 0)
+	require.Empty(t, consumer.ports)
+	action.keepAlive(context.Background())
+	require.Equal(t, []uint16{1000}, consumer.ports)
+	action.keepAlive(context.Background())
+	require.Equal(t, []uint16{1000}, consumer.ports, "consumer told the same port twice")
+}
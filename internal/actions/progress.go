@@ -0,0 +1,62 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const progressBarWidth = 30
+
+// progressBar is a single line progress bar that is redrawn in place as work completes; it's safe
+// to step from many goroutines
+type progressBar struct {
+	lock  sync.Mutex
+	out   io.Writer
+	total int
+	done  int
+}
+
+func newProgressBar(out io.Writer, total int) *progressBar {
+	return &progressBar{
+		out:   out,
+		total: total,
+	}
+}
+
+// step marks one more unit of work as complete; label describes the completed work
+func (p *progressBar) step(label string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done++
+	filled := progressBarWidth
+	if p.total > 0 {
+		filled = p.done * progressBarWidth / p.total
+	}
+	fmt.Fprintf(p.out, "\r[%s%s] %4d/%-4d %-24.24s",
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), p.done, p.total, label)
+}
+
+func (p *progressBar) finish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	fmt.Fprintln(p.out)
+}
@@ -0,0 +1,84 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+)
+
+type RefreshCmd struct {
+	Interface   string `help:"name of the running wg device to refresh" default:"pia" placeholder:"NAME"`
+	PiaId       string `required help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword string `required help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId string `help:"PIA region id to move the device to, or auto for the region with the lowest latency; defaults to the device's current region" placeholder:"ID"`
+	AutoRegion  string `help:"with --pia-region-id auto, only consider the regions whose name or id contains SEARCH" placeholder:"SEARCH"`
+}
+
+func (cmd *RefreshCmd) Run(state *appstate.State) error {
+	mgr, err := wgdevice.New()
+	if err != nil {
+		return err
+	}
+	defer mgr.Close()
+	dev, err := mgr.Device(cmd.Interface)
+	if err != nil {
+		return err
+	}
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	regionId, err := pickRegion(state.Context, pia, cmd.PiaRegionId, cmd.AutoRegion)
+	if err != nil {
+		return err
+	}
+	if len(regionId) == 0 {
+		if len(dev.Peers) == 0 || dev.Peers[0].Endpoint == nil {
+			return fmt.Errorf("%s has no peer; use --pia-region-id to pick a region", cmd.Interface)
+		}
+		regions, err := pia.GetRegions()
+		if err != nil {
+			return err
+		}
+		region, err := regionForEndpoint(regions, dev.Peers[0].Endpoint.IP.String())
+		if err != nil {
+			return fmt.Errorf("unable to find the current region of %s, use --pia-region-id: %w", cmd.Interface, err)
+		}
+		regionId = region.Id
+	}
+	log.V(1).Info("re-registering key", "interface", cmd.Interface, logging.KeyRegion, regionId)
+	iface, err := pia.CreateTunnelWithKey(cmd.PiaId, cmd.PiaPassword, regionId, dev.PrivateKey)
+	if err != nil {
+		return err
+	}
+	changes, err := mgr.Refresh(cmd.Interface, iface)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s refreshed; nothing changed\n", cmd.Interface)
+		return nil
+	}
+	fmt.Printf("%s refreshed:\n", cmd.Interface)
+	for _, c := range changes {
+		fmt.Printf("  %s: %s -> %s\n", c.Setting, c.From, c.To)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/metrics"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/rotation"
+)
+
+type RotateCmd struct {
+	Interface     string   `help:"rotate the key of this running wg device" placeholder:"NAME" xor:"target"`
+	Config        string   `help:"rotate the key in this wg config, created by create-config, by rewriting it" placeholder:"FILE" xor:"target"`
+	PiaId         string   `required help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword   string   `required help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId   string   `help:"PIA region id to register new keys with, or auto for the region with the lowest latency at startup; defaults to the current region" placeholder:"ID"`
+	AutoRegion    string   `help:"with --pia-region-id auto, only consider the regions whose name or id contains SEARCH" placeholder:"SEARCH"`
+	Regions       []string `help:"cycle through these regions, one per rotation, instead of staying in one region" placeholder:"ID,..."`
+	Schedule      string   `help:"when to rotate, as a cron spec (i.e. '0 */6 * * *') or descriptor (i.e. @daily, '@every 12h')" placeholder:"SPEC"`
+	Once          bool     `help:"rotate once, right away, and exit; for use with an external scheduler"`
+	HistoryFile   string   `help:"where rotations are recorded; defaults to the cache dir" placeholder:"FILE"`
+	IgnorePiaDns  bool     `help:"do not set DNS servers to PIA servers"`
+	NoRoutes      bool     `help:"do not route all traffic through the tunnel, only the server virtual ip; only applies to --interface"`
+	MetricsListen string   `help:"serve prometheus metrics on this address, i.e. :9586; ignored with --once" placeholder:"ADDR"`
+
+	Mode           string `help:"file mode of the rewritten config; only applies to --config" default:"0600" placeholder:"MODE"`
+	Owner          string `help:"user to give the rewritten config to; only applies to --config" placeholder:"USER"`
+	Group          string `help:"group to give the rewritten config to; only applies to --config" placeholder:"GROUP"`
+	Backup         bool   `help:"keep the config being replaced as FILE.bak; only applies to --config" default:"1" negatable`
+	FollowSymlinks bool   `help:"when the config is a symlink, rewrite its target instead of failing; only applies to --config"`
+}
+
+func (cmd *RotateCmd) Run(state *appstate.State) error {
+	if len(cmd.Interface) == 0 && len(cmd.Config) == 0 {
+		return fmt.Errorf("one of --interface or --config is required")
+	}
+	if !cmd.Once && len(cmd.Schedule) == 0 {
+		return fmt.Errorf("one of --schedule or --once is required")
+	}
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	chosen, err := pickRegion(state.Context, pia, cmd.PiaRegionId, cmd.AutoRegion)
+	if err != nil {
+		return err
+	}
+	cfg := rotation.Config{
+		PiaId:       cmd.PiaId,
+		PiaPassword: cmd.PiaPassword,
+		History:     rotationHistory(cmd.HistoryFile, state),
+	}
+	var current string
+	if len(cmd.Interface) > 0 {
+		mgr, err := wgdevice.New()
+		if err != nil {
+			return err
+		}
+		defer mgr.Close()
+		opts := wgdevice.Options{Routes: !cmd.NoRoutes, Dns: !cmd.IgnorePiaDns}
+		cfg.Target = cmd.Interface
+		cfg.Apply = func(iface piaclient.PiaInterface) error {
+			if err := mgr.Up(cmd.Interface, iface, opts); err != nil {
+				return err
+			}
+			metrics.Reregistered(cmd.Interface, iface.PiaRegion.Id)
+			metrics.SetRegion(cmd.Interface, iface.PiaRegion.Id)
+			return nil
+		}
+		if len(cmd.MetricsListen) > 0 && !cmd.Once {
+			metrics.WatchDevice(cmd.Interface, mgr.Device)
+		}
+		if current, err = deviceRegion(mgr, cmd.Interface, pia); err != nil && len(chosen) == 0 && len(cmd.Regions) == 0 {
+			return fmt.Errorf("%w; use --pia-region-id", err)
+		}
+	} else {
+		opts, err := configFileOptions(cmd.Mode, cmd.Owner, cmd.Group, cmd.Backup, cmd.FollowSymlinks)
+		if err != nil {
+			return err
+		}
+		cfg.Target = cmd.Config
+		cfg.Apply = func(iface piaclient.PiaInterface) error {
+			return cmd.writeConfig(iface, opts)
+		}
+		if data, err := ioutil.ReadFile(cmd.Config); err == nil {
+			_, current, _ = parseWgConfig(string(data))
+		}
+	}
+	cfg.Region = rotationRegions(cmd.Regions, chosen, current)
+	if cfg.Region == nil {
+		return fmt.Errorf("unable to find the current region of %s; use --pia-region-id", cfg.Target)
+	}
+	if len(cmd.Schedule) > 0 {
+		schedule, err := rotation.ParseSchedule(cmd.Schedule)
+		if err != nil {
+			return err
+		}
+		cfg.Schedule = schedule
+	}
+	rotator := rotation.New(cfg, pia)
+	if cmd.Once {
+		rec, err := rotator.Rotate()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s rotated to %s via %s; new public key %s\n", rec.Target, rec.Region, rec.ServerEndpoint, rec.ClientPublicKey)
+		return nil
+	}
+	if len(cmd.MetricsListen) > 0 {
+		if err := metrics.Serve(state.Context, cmd.MetricsListen); err != nil {
+			return err
+		}
+	}
+	return rotator.Run(state.Context)
+}
+
+func (cmd *RotateCmd) writeConfig(iface piaclient.PiaInterface, opts secretFileOptions) error {
+	if cmd.IgnorePiaDns {
+		iface.DnsServers = nil
+	}
+	iface.CreatedOn = time.Now().Format(time.UnixDate)
+	// the new config sends the same traffic through the tunnel as the one it replaces
+	var allowed []net.IPNet
+	killSwitch := false
+	if data, err := ioutil.ReadFile(cmd.Config); err == nil {
+		allowed, killSwitch = parseWgConfigRouting(string(data))
+	}
+	result, err := processTemplate(wgConfTmpl, newWgConfig(iface, allowed, killSwitch))
+	if err != nil {
+		return fmt.Errorf("template processing failed: %w", err)
+	}
+	return writeConfigFile(cmd.Config, result, opts)
+}
+
+// deviceRegion finds the region of the running device's peer
+func deviceRegion(mgr *wgdevice.Manager, name string, pia piaclient.PiaClient) (string, error) {
+	dev, err := mgr.Device(name)
+	if err != nil {
+		return "", err
+	}
+	if len(dev.Peers) == 0 || dev.Peers[0].Endpoint == nil {
+		return "", fmt.Errorf("%s has no peer", name)
+	}
+	regions, err := pia.GetRegions()
+	if err != nil {
+		return "", err
+	}
+	r, err := regionForEndpoint(regions, dev.Peers[0].Endpoint.IP.String())
+	if err != nil {
+		return "", err
+	}
+	return r.Id, nil
+}
+
+// rotationRegions returns the func picking the region of each rotation: cycling through regions
+// when given, otherwise always the chosen region or, failing that, the current one; nil when
+// there's nothing to pick from
+func rotationRegions(regions []string, chosen string, current string) func() string {
+	if len(regions) > 0 {
+		return rotation.Cycle(regions)
+	}
+	if len(chosen) == 0 {
+		chosen = current
+	}
+	if len(chosen) == 0 {
+		return nil
+	}
+	return func() string { return chosen }
+}
+
+// rotationHistory returns the history at the given path, defaulting to the cache dir; nil when
+// there's nowhere to keep it
+func rotationHistory(path string, state *appstate.State) *rotation.History {
+	if len(path) == 0 && len(state.PiaOptions.CacheDir) > 0 {
+		path = filepath.Join(state.PiaOptions.CacheDir, "rotations.jsonl")
+	}
+	if len(path) == 0 {
+		return nil
+	}
+	return rotation.NewHistory(path)
+}
@@ -0,0 +1,103 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+func TestRotationRegions(t *testing.T) {
+	next := rotationRegions([]string{"a", "b"}, "c", "d")
+	require.Equal(t, []string{"a", "b", "a"}, []string{next(), next(), next()})
+	require.Equal(t, "c", rotationRegions(nil, "c", "d")())
+	require.Equal(t, "d", rotationRegions(nil, "", "d")())
+	require.Nil(t, rotationRegions(nil, "", ""))
+}
+
+func TestRotateWritesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pia.conf")
+	cmd := RotateCmd{Config: path, IgnorePiaDns: true}
+	iface := piaclient.PiaInterface{
+		ServerPublicKey:  "srvkey",
+		ServerPort:       1337,
+		ServerEndpoint:   "10.1.2.3",
+		ServerVirtualIp:  "10.0.0.1",
+		ClientIp:         "10.0.0.2",
+		ClientPublicKey:  "pubkey",
+		ClientPrivateKey: "privkey",
+		DnsServers:       []string{"10.0.0.243"},
+		PiaRegion:        piaclient.PiaRegion{Id: "ca_toronto", Name: "CA Toronto"},
+	}
+	opts := secretFileOptions{perm: 0600, backup: true}
+	require.NoError(t, cmd.writeConfig(iface, opts))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	parsed, regionId, err := parseWgConfig(string(data))
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regionId)
+	require.Equal(t, "privkey", parsed.ClientPrivateKey)
+	require.Empty(t, parsed.DnsServers)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// the next rotation keeps the config it replaces, as create-config does
+	iface.ClientPrivateKey = "privkey2"
+	require.NoError(t, cmd.writeConfig(iface, opts))
+	backup, err := ioutil.ReadFile(path + ".bak")
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(backup))
+
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(filepath.Dir(path), "link.conf")
+		require.NoError(t, os.Symlink(path, link))
+		require.Error(t, (&RotateCmd{Config: link}).writeConfig(iface, opts))
+	}
+}
+
+func TestRotateKeepsConfigRouting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pia.conf")
+	iface := piaclient.PiaInterface{
+		ServerEndpoint:  "192.0.2.1",
+		ServerVirtualIp: "10.0.0.1",
+		ClientIp:        "10.0.0.2",
+		PiaRegion:       piaclient.PiaRegion{Id: "ca_toronto"},
+	}
+	allowed, err := parseAllowedIps([]string{"198.51.100.0/24"})
+	require.NoError(t, err)
+	config, err := processTemplate(wgConfTmpl, newWgConfig(iface, allowed, true))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+
+	iface.ServerEndpoint = "192.0.2.2"
+	iface.ServerVirtualIp = "10.0.0.5"
+	require.NoError(t, (&RotateCmd{Config: path}).writeConfig(iface, secretFileOptions{perm: 0600}))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "AllowedIPs = 198.51.100.0/24, 10.0.0.5/32\n")
+	require.Contains(t, string(data), "! -d 192.0.2.2 ")
+}
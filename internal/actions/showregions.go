@@ -18,111 +18,229 @@
 package actions
 
 import (
+	"context"
 	"fmt"
+	"io"
+	stdos "os"
 	"sort"
 	"strings"
+	"time"
 
-	"github.com/jamesrr39/semaphore"
 	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/metrics"
 	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
 	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
-	"k8s.io/klog/v2"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/workpool"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// port the PIA meta servers serve https on
+const metaPort = 443
+
 type ShowRegionsCmd struct {
-	CaseSensitive bool   `help:"case sensitive searching" default:"1" negatable`
-	Ping          bool   `optional help:"ping each region and sort results by ping time" default:"0"`
-	SortBy        string `optional help:"sort results by given field" enum:"id,name" default:"name"`
-	SortOrder     string `optional help:"sort results ASCending or DESCending order" enum:"asc,desc" default:"asc"`
-	Search        string `optional help:"find regions containing search term"`
-	Threads       uint8  `optional help:"max number of worker threads for pinging regions" default:"8"`
-	Samples       uint8  `optional help:"number of samples to take when pinging regions" default:"3"`
+	CaseSensitive bool          `help:"case sensitive searching" default:"1" negatable`
+	Ping          bool          `optional help:"ping each region and sort results by ping time" default:"0"`
+	SortBy        string        `optional help:"sort results by given field" enum:"id,name" default:"name"`
+	SortOrder     string        `optional help:"sort results ASCending or DESCending order" enum:"asc,desc" default:"asc"`
+	Search        string        `optional help:"find regions containing search term"`
+	Threads       uint8         `optional help:"max number of worker threads for pinging regions" default:"8"`
+	Samples       uint8         `optional help:"number of samples to take when pinging regions" default:"3"`
+	PingSort      string        `optional help:"latency metric to sort results by when pinging" enum:"min,avg,max,jitter,loss" default:"avg"`
+	Probe         string        `optional help:"how to measure region latency: icmp ping, tcp connect to the meta server or wg handshake with the wg server" enum:"icmp,tcp,wg" default:"icmp"`
+	PiaId         string        `optional help:"PIA user id; required by the wg probe to register a key with each region" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword   string        `optional help:"PIA password; required by the wg probe to register a key with each region" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PingTimeout   time.Duration `optional help:"max time to spend probing a single region" default:"5s"`
+	Offline       bool          `optional help:"only use the cached server list; never download it"`
+	Progress      bool          `optional help:"show a live progress bar on stderr while pinging regions"`
+	Deadline      time.Duration `optional help:"max time to spend probing all regions; regions not probed in time are reported as unreachable (0 = no limit)" default:"0"`
 }
 
 func (cmd *ShowRegionsCmd) Run(state *appstate.State) error {
+	opts := state.PiaOptions
+	opts.Offline = cmd.Offline
 	action := showRegionsAction{
-		pia:    piaclient.New(state.ServerList),
-		pinger: os.NewPinger(),
-		cmd:    cmd,
+		appState: state,
+		pia:      piaclient.NewWithOptions(state.ServerList, opts),
+		pinger:   newPinger(cmd.Probe, cmd.PingTimeout),
+		cmd:      cmd,
 	}
 	return action.run()
 }
 
+func newPinger(probe string, timeout time.Duration) os.Pinger {
+	switch probe {
+	case "tcp":
+		return os.NewTcpPinger(metaPort, timeout)
+	case "wg":
+		// wg pingers are keyed to a registered tunnel so are created per region
+		return nil
+	default:
+		return os.NewPinger(timeout)
+	}
+}
+
 type showRegionsAction struct {
 	cmd      *ShowRegionsCmd
 	appState *appstate.State
 	pinger   os.Pinger
 	pia      piaclient.PiaClient
+	progress io.Writer // where progress is drawn; stderr when nil
+	token    string    // auth token the wg probe registers its keys with
 }
 
 func (action showRegionsAction) run() error {
 	cmd := action.cmd
+	if cmd.Ping && cmd.Probe == "wg" && (len(cmd.PiaId) == 0 || len(cmd.PiaPassword) == 0) {
+		return fmt.Errorf("the wg probe requires --pia-id and --pia-password")
+	}
 	pia, err := action.pia.GetRegions()
 	if err != nil {
 		return err
 	}
 	if len(cmd.Search) > 0 {
-		klog.V(5).Infof("applying region filter: %s", cmd.Search)
+		log.V(5).Info("applying region filter", "search", cmd.Search)
 		pia.Regions = action.filter(pia.Regions)
 	}
 	if cmd.Ping {
-		klog.V(5).Info("pinging regions")
-		action.pingRegions(pia.Regions)
+		log.V(5).Info("pinging regions")
+		ctx := action.context()
+		pingCtx := ctx
+		if cmd.Deadline > 0 {
+			var cancel context.CancelFunc
+			pingCtx, cancel = context.WithTimeout(ctx, cmd.Deadline)
+			defer cancel()
+		}
+		if cmd.Probe == "wg" && len(pia.Regions) > 0 {
+			// a token is good for every region so it's fetched once rather than per region
+			if action.token, err = action.pia.Authenticate(cmd.PiaId, cmd.PiaPassword, pia.Regions[0].Id); err != nil {
+				return err
+			}
+		}
+		action.pingRegions(pingCtx, pia.Regions)
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted: %w", ctx.Err())
+		}
 	}
 	action.sortRegions(pia.Regions)
 	action.printRegions(pia.Regions)
 	return nil
 }
 
+func (action showRegionsAction) context() context.Context {
+	if action.appState == nil || action.appState.Context == nil {
+		return context.Background()
+	}
+	return action.appState.Context
+}
+
 func (action showRegionsAction) printRegions(regions []piaclient.PiaRegion) {
-	fmt.Printf("%-24s %-18s %-9s\n", "NAME", "ID", "PING (ms)")
-	fmt.Printf("%43s\n", strings.Repeat("=", 53))
+	if !action.cmd.Ping {
+		fmt.Printf("%-24s %-18s\n", "NAME", "ID")
+		fmt.Printf("%s\n", strings.Repeat("=", 43))
+		for _, r := range regions {
+			fmt.Printf("%-24s %-18s\n", r.Name, r.Id)
+		}
+		return
+	}
+	fmt.Printf("%-24s %-18s %9s %9s %9s %9s %6s\n", "NAME", "ID", "MIN (ms)", "AVG (ms)", "MAX (ms)", "JITTER", "LOSS")
+	fmt.Printf("%s\n", strings.Repeat("=", 90))
 	for _, r := range regions {
-		ping := fmt.Sprint(r.Ping)
-		if r.Ping == 0 {
-			ping = ""
+		if !r.Ping.Reachable() {
+			fmt.Printf("%-24s %-18s %9s\n", r.Name, r.Id, "unreachable")
+			continue
 		}
-		fmt.Printf("%-24s %-18s %9s\n", r.Name, r.Id, ping)
+		fmt.Printf("%-24s %-18s %9s %9s %9s %9s %5.0f%%\n", r.Name, r.Id,
+			formatMillis(r.Ping.Min), formatMillis(r.Ping.Avg), formatMillis(r.Ping.Max), formatMillis(r.Ping.Jitter),
+			r.Ping.Loss()*100)
 	}
 }
 
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+}
+
 func (action showRegionsAction) sortRegions(regions []piaclient.PiaRegion) {
 	cmd := action.cmd
-	sort.Slice(regions,
+	sort.SliceStable(regions,
 		func(i, j int) bool {
+			if cmd.Ping && regions[i].Ping.Reachable() != regions[j].Ping.Reachable() {
+				// unreachable regions always go to the bottom of the list
+				return regions[i].Ping.Reachable()
+			}
 			if cmd.SortOrder != "asc" {
-				klog.V(5).Info("sort order: desc")
+				log.V(5).Info("sort order", "order", "desc")
 				tmp := i
 				i = j
 				j = tmp
 			} else {
-				klog.V(5).Info("sort order: asc")
+				log.V(5).Info("sort order", "order", "asc")
 			}
 			if cmd.Ping {
-				klog.V(5).Info("sort key: ping")
-				return regions[i].Ping < regions[j].Ping
+				log.V(5).Info("sort key", "key", "ping "+cmd.PingSort)
+				return pingMetric(regions[i].Ping, cmd.PingSort) < pingMetric(regions[j].Ping, cmd.PingSort)
 			} else if cmd.SortBy == "name" {
-				klog.V(5).Info("sort key: name")
+				log.V(5).Info("sort key", "key", "name")
 				return regions[i].Name < regions[j].Name
 			} else {
-				klog.V(5).Info("sort name: id")
+				log.V(5).Info("sort key", "key", "id")
 				return regions[i].Id < regions[j].Id
 			}
 		})
 }
 
-func (action showRegionsAction) pingRegions(regions []piaclient.PiaRegion) {
-	sem := semaphore.NewSemaphore(uint(action.cmd.Threads))
+func pingMetric(r os.PingResult, metric string) float64 {
+	switch metric {
+	case "min":
+		return float64(r.Min)
+	case "max":
+		return float64(r.Max)
+	case "jitter":
+		return float64(r.Jitter)
+	case "loss":
+		return r.Loss()
+	default:
+		return float64(r.Avg)
+	}
+}
+
+func (action showRegionsAction) pingRegions(ctx context.Context, regions []piaclient.PiaRegion) {
+	var progress *progressBar
+	if action.cmd.Progress {
+		progress = newProgressBar(action.progressOut(), len(regions))
+		defer progress.finish()
+	}
+	jobs := make([]workpool.Job, len(regions))
 	for i := range regions {
-		offset := i
-		sem.Add()
-		go func() {
-			defer sem.Done()
-			regions[offset] = action.doPing(regions[offset])
-		}()
+		r := regions[i]
+		jobs[i] = func(ctx context.Context) (interface{}, error) {
+			pinged := action.doPing(ctx, r)
+			// step as each region finishes rather than as results arrive, in order, behind the slowest
+			if progress != nil {
+				progress.step(r.Name)
+			}
+			return pinged, nil
+		}
+	}
+	log.V(4).Info("pinging regions", "count", len(regions), "workers", action.cmd.Threads)
+	for result := range workpool.New(int(action.cmd.Threads)).Run(ctx, jobs) {
+		if result.Err != nil {
+			// the deadline passed (or we were interrupted) before this region's turn came up
+			regions[result.Index].Ping = os.PingResult{Sent: int(action.cmd.Samples), Err: result.Err}
+			if progress != nil {
+				progress.step(regions[result.Index].Name)
+			}
+		} else {
+			regions[result.Index] = result.Value.(piaclient.PiaRegion)
+		}
 	}
-	klog.V(4).Infof("waiting on ~%d workers", sem.CurrentlyRunning())
-	sem.Wait()
+}
+
+func (action showRegionsAction) progressOut() io.Writer {
+	if action.progress != nil {
+		return action.progress
+	}
+	return stdos.Stderr
 }
 
 func (action showRegionsAction) isMatch(r piaclient.PiaRegion) bool {
@@ -137,29 +255,73 @@ func (action showRegionsAction) isMatch(r piaclient.PiaRegion) bool {
 		searchId = r.Id
 		searchPredicate = searchTerm
 	}
-	klog.V(4).Infof("n=%s, i=%s, p=%s", searchName, searchId, searchPredicate)
+	log.V(4).Info("matching region", "name", searchName, logging.KeyRegion, searchId, "search", searchPredicate)
 	return strings.Contains(searchName, searchPredicate) || strings.Contains(searchId, searchPredicate)
 }
 
-func (action showRegionsAction) doPing(r piaclient.PiaRegion) piaclient.PiaRegion {
-	ping, err := action.pinger.Ping(r.Dns, action.cmd.Samples)
-	if err != nil {
-		klog.Errorf("ping failed: %s\n%v", r.Name, err)
-		ping = 10000
+func (action showRegionsAction) doPing(ctx context.Context, r piaclient.PiaRegion) piaclient.PiaRegion {
+	ctx = logging.WithRegionContext(ctx, r.Id)
+	start := time.Now()
+	pinger, host, err := action.probeTarget(ctx, r)
+	var ping os.PingResult
+	if err == nil {
+		ping = pinger.Ping(ctx, host, action.cmd.Samples)
+	} else {
+		ping = os.PingResult{Sent: int(action.cmd.Samples), Err: err}
 	}
-	region := piaclient.PiaRegion{Id: r.Id, Name: r.Name, Ping: ping, Dns: r.Dns}
-	klog.V(5).Infof("region pinged: %v", region)
+	if ping.Err != nil {
+		log.Error(ping.Err, "ping failed", logging.KeyRegion, r.Id, "name", r.Name)
+	}
+	metrics.ObserveProbe(r.Id, ping)
+	region := piaclient.PiaRegion{Id: r.Id, Name: r.Name, Ping: ping, Dns: r.Dns, Servers: r.Servers}
+	log.V(5).Info("region pinged", logging.KeyRegion, r.Id, logging.KeyDuration, time.Since(start),
+		"avg", ping.Avg, "loss", ping.Loss())
 	return region
 }
 
+// probeTarget returns the pinger and host to use to measure the latency of the given region
+func (action showRegionsAction) probeTarget(ctx context.Context, r piaclient.PiaRegion) (os.Pinger, string, error) {
+	switch action.cmd.Probe {
+	case "tcp":
+		if len(r.Servers.Meta) == 0 {
+			return nil, "", fmt.Errorf("region has no meta servers: %s", r.Id)
+		}
+		return action.pinger, r.Servers.Meta[0].Ip, nil
+	case "wg":
+		// wg servers only answer handshakes from registered peers so a key must be registered first;
+		// registering can't be cancelled so the deadline is checked either side of it
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		iface, err := action.pia.CreateTunnelWithToken(action.token, r.Id)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		serverKey, err := wgtypes.ParseKey(iface.ServerPublicKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid server key: %w", err)
+		}
+		clientKey, err := wgtypes.ParseKey(iface.ClientPrivateKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid client key: %w", err)
+		}
+		return os.NewWgPinger(iface.ServerPort, action.cmd.PingTimeout, serverKey, clientKey), iface.ServerEndpoint, nil
+	default:
+		return action.pinger, r.Dns, nil
+	}
+}
+
 func (action showRegionsAction) filter(regions []piaclient.PiaRegion) []piaclient.PiaRegion {
 	var filtered []piaclient.PiaRegion
 	for _, r := range regions {
 		if action.isMatch(r) {
 			filtered = append(filtered, r)
-			klog.V(4).Infof("region %s: matched filter", r.Name)
+			log.V(4).Info("region matched filter", logging.KeyRegion, r.Id, "name", r.Name)
 		} else {
-			klog.V(4).Infof("region %s: did not match filter", r.Name)
+			log.V(4).Info("region did not match filter", logging.KeyRegion, r.Id, "name", r.Name)
 		}
 	}
 	return filtered
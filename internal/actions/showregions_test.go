@@ -18,8 +18,12 @@
 package actions
 
 import (
+	"context"
+	"errors"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
@@ -29,22 +33,34 @@ import (
 // https://github.com/stretchr/testify
 // TODO table driven tests
 
+func pingMs(ms int) os.PingResult {
+	return os.PingResult{Sent: 1, Received: 1, Avg: time.Duration(ms) * time.Millisecond}
+}
+
+func pingResults(r []piaclient.PiaRegion) []int64 {
+	var vals []int64
+	for _, it := range r {
+		vals = append(vals, it.Ping.Avg.Milliseconds())
+	}
+	return vals
+}
+
 var regions = []piaclient.PiaRegion{
-	{Id: "a", Name: "f", Ping: 0},
-	{Id: "b", Name: "b", Ping: 1},
-	{Id: "c", Name: "e", Ping: 2},
-	{Id: "d", Name: "c", Ping: 3},
-	{Id: "e", Name: "d", Ping: 4},
-	{Id: "f", Name: "a", Ping: 5},
+	{Id: "a", Name: "f", Ping: pingMs(0)},
+	{Id: "b", Name: "b", Ping: pingMs(1)},
+	{Id: "c", Name: "e", Ping: pingMs(2)},
+	{Id: "d", Name: "c", Ping: pingMs(3)},
+	{Id: "e", Name: "d", Ping: pingMs(4)},
+	{Id: "f", Name: "a", Ping: pingMs(5)},
 }
 
 var regionsMixedCase = []piaclient.PiaRegion{
-	{Id: "a", Name: "f", Ping: 0},
-	{Id: "B", Name: "b", Ping: 1},
-	{Id: "c", Name: "E", Ping: 2},
-	{Id: "D", Name: "C", Ping: 3},
-	{Id: "e", Name: "d", Ping: 4},
-	{Id: "F", Name: "A", Ping: 5},
+	{Id: "a", Name: "f", Ping: pingMs(0)},
+	{Id: "B", Name: "b", Ping: pingMs(1)},
+	{Id: "c", Name: "E", Ping: pingMs(2)},
+	{Id: "D", Name: "C", Ping: pingMs(3)},
+	{Id: "e", Name: "d", Ping: pingMs(4)},
+	{Id: "F", Name: "A", Ping: pingMs(5)},
 }
 
 func TestIsMatchNameOnly(t *testing.T) {
@@ -114,23 +130,17 @@ func TestIsMatchNameOnlyCaseSensitive(t *testing.T) {
 func TestSortRegionsAscendingByPing(t *testing.T) {
 	var c = ShowRegionsCmd{
 		Ping:      true,
+		PingSort:  "avg",
 		SortOrder: "asc",
 	}
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
-	result := func(r []piaclient.PiaRegion) []uint16 {
-		var vals []uint16
-		for _, it := range r {
-			vals = append(vals, it.Ping)
-		}
-		return vals
-	}(regions)
-	require.Equal(t, []uint16{0, 1, 2, 3, 4, 5}, result, "not equal")
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5}, pingResults(regions), "not equal")
 }
 
 func TestSortRegionsAscendingById(t *testing.T) {
@@ -142,7 +152,7 @@ func TestSortRegionsAscendingById(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
@@ -165,7 +175,7 @@ func TestSortRegionsAscendingByName(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
@@ -182,23 +192,17 @@ func TestSortRegionsAscendingByName(t *testing.T) {
 func TestSortRegionsDescendingByPing(t *testing.T) {
 	var c = ShowRegionsCmd{
 		Ping:      true,
+		PingSort:  "avg",
 		SortOrder: "desc",
 	}
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
-	result := func(r []piaclient.PiaRegion) []uint16 {
-		var vals []uint16
-		for _, it := range r {
-			vals = append(vals, it.Ping)
-		}
-		return vals
-	}(regions)
-	require.Equal(t, []uint16{5, 4, 3, 2, 1, 0}, result, "not equal")
+	require.Equal(t, []int64{5, 4, 3, 2, 1, 0}, pingResults(regions), "not equal")
 }
 
 func TestSortRegionsDesccendingById(t *testing.T) {
@@ -210,7 +214,7 @@ func TestSortRegionsDesccendingById(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
@@ -233,7 +237,7 @@ func TestSortRegionsDescendingByName(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regions)
@@ -256,7 +260,7 @@ func TestSortRegionsAscendingByIdCaseSensitive(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regionsMixedCase)
@@ -279,7 +283,7 @@ func TestSortRegionsAscendingByNameCaseSensitive(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regionsMixedCase)
@@ -302,7 +306,7 @@ func TestSortRegionsDesccendingByIdCaseSensitive(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regionsMixedCase)
@@ -325,7 +329,7 @@ func TestSortRegionsDescendingByNameCaseSensitve(t *testing.T) {
 	var a = showRegionsAction{
 		cmd:      &c,
 		appState: nil,
-		pinger:   os.NewPinger(),
+		pinger:   os.NewPinger(os.DefaultTimeout),
 		pia:      nil,
 	}
 	a.sortRegions(regionsMixedCase)
@@ -338,3 +342,188 @@ func TestSortRegionsDescendingByNameCaseSensitve(t *testing.T) {
 	}(regionsMixedCase)
 	require.Equal(t, []string{"f", "d", "b", "E", "C", "A"}, result, "not equal")
 }
+
+func TestSortRegionsUnreachableLast(t *testing.T) {
+	for _, order := range []string{"asc", "desc"} {
+		var c = ShowRegionsCmd{
+			Ping:      true,
+			PingSort:  "avg",
+			SortOrder: order,
+		}
+		var a = showRegionsAction{
+			cmd: &c,
+		}
+		r := []piaclient.PiaRegion{
+			{Id: "a", Ping: os.PingResult{Sent: 3, Err: errors.New("timeout")}},
+			{Id: "b", Ping: pingMs(5)},
+			{Id: "c", Ping: os.PingResult{Sent: 3, Received: 0}},
+			{Id: "d", Ping: pingMs(1)},
+		}
+		a.sortRegions(r)
+		require.Equal(t, []bool{true, true, false, false}, []bool{r[0].Ping.Reachable(), r[1].Ping.Reachable(), r[2].Ping.Reachable(), r[3].Ping.Reachable()}, order)
+	}
+}
+
+func TestSortRegionsByLoss(t *testing.T) {
+	var c = ShowRegionsCmd{
+		Ping:      true,
+		PingSort:  "loss",
+		SortOrder: "asc",
+	}
+	var a = showRegionsAction{
+		cmd: &c,
+	}
+	r := []piaclient.PiaRegion{
+		{Id: "a", Ping: os.PingResult{Sent: 4, Received: 2, Avg: time.Millisecond}},
+		{Id: "b", Ping: os.PingResult{Sent: 4, Received: 4, Avg: 9 * time.Millisecond}},
+		{Id: "c", Ping: os.PingResult{Sent: 4, Received: 3, Avg: 5 * time.Millisecond}},
+	}
+	a.sortRegions(r)
+	require.Equal(t, []string{"b", "c", "a"}, []string{r[0].Id, r[1].Id, r[2].Id})
+}
+
+// stuckPinger never gets a reply and only returns once its probe is cancelled
+type stuckPinger struct{}
+
+func (p stuckPinger) Ping(ctx context.Context, host string, samples uint8) os.PingResult {
+	<-ctx.Done()
+	return os.PingResult{Sent: int(samples), Err: ctx.Err()}
+}
+
+func TestPingRegionsDeadline(t *testing.T) {
+	var c = ShowRegionsCmd{
+		Ping:    true,
+		Threads: 2,
+		Samples: 1,
+	}
+	var a = showRegionsAction{
+		cmd:    &c,
+		pinger: stuckPinger{},
+	}
+	r := []piaclient.PiaRegion{{Id: "a"}, {Id: "b"}, {Id: "c"}, {Id: "d"}, {Id: "e"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	a.pingRegions(ctx, r)
+	require.True(t, time.Since(start) < 5*time.Second)
+	for _, it := range r {
+		require.False(t, it.Ping.Reachable())
+		require.ErrorIs(t, it.Ping.Err, context.DeadlineExceeded)
+	}
+}
+
+type fixedPinger struct{}
+
+func (p fixedPinger) Ping(ctx context.Context, host string, samples uint8) os.PingResult {
+	return pingMs(len(host))
+}
+
+func TestPingRegionsProgress(t *testing.T) {
+	var c = ShowRegionsCmd{
+		Ping:     true,
+		Threads:  3,
+		Samples:  1,
+		Progress: true,
+	}
+	out := &strings.Builder{}
+	var a = showRegionsAction{
+		cmd:      &c,
+		pinger:   fixedPinger{},
+		progress: out,
+	}
+	r := []piaclient.PiaRegion{{Id: "a", Dns: "aaa"}, {Id: "b", Dns: "b"}, {Id: "c", Dns: "cc"}}
+	a.pingRegions(context.Background(), r)
+	require.Equal(t, []int64{3, 1, 2}, pingResults(r))
+	require.Contains(t, out.String(), "3/3")
+}
+
+// slowFirstPinger holds up the probe of host "slow" until every other probe is done
+type slowFirstPinger struct {
+	others *sync.WaitGroup
+}
+
+func (p slowFirstPinger) Ping(ctx context.Context, host string, samples uint8) os.PingResult {
+	if host == "slow" {
+		p.others.Wait()
+	} else {
+		defer p.others.Done()
+	}
+	return pingMs(1)
+}
+
+func TestPingRegionsProgressStepsOnCompletion(t *testing.T) {
+	var c = ShowRegionsCmd{
+		Ping:     true,
+		Threads:  3,
+		Samples:  1,
+		Progress: true,
+	}
+	others := &sync.WaitGroup{}
+	others.Add(2)
+	out := &strings.Builder{}
+	var a = showRegionsAction{
+		cmd:      &c,
+		pinger:   slowFirstPinger{others},
+		progress: out,
+	}
+	r := []piaclient.PiaRegion{{Name: "Slow", Dns: "slow"}, {Name: "Fast1", Dns: "fast1"}, {Name: "Fast2", Dns: "fast2"}}
+	a.pingRegions(context.Background(), r)
+	drawn := out.String()
+	require.Regexp(t, `3/3 +Slow`, drawn)
+	require.Less(t, strings.Index(drawn, "Fast"), strings.Index(drawn, "Slow"))
+}
+
+// wgProbePia registers tunnels for the wg probe, failing each so no handshake is attempted
+type wgProbePia struct {
+	piaclient.PiaClient
+	lock       sync.Mutex
+	auths      int
+	registered []string
+}
+
+func (p *wgProbePia) GetRegions() (piaclient.PiaRegions, error) {
+	return piaclient.PiaRegions{Regions: []piaclient.PiaRegion{{Id: "a"}, {Id: "b"}, {Id: "c"}}}, nil
+}
+
+func (p *wgProbePia) Authenticate(id string, pwd string, regionId string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.auths++
+	return "token", nil
+}
+
+func (p *wgProbePia) CreateTunnelWithToken(token string, regionId string) (piaclient.PiaInterface, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.registered = append(p.registered, token+"@"+regionId)
+	return piaclient.PiaInterface{}, errors.New("addKey failed")
+}
+
+func TestWgProbeAuthenticatesOnce(t *testing.T) {
+	pia := &wgProbePia{}
+	a := showRegionsAction{
+		cmd: &ShowRegionsCmd{
+			Ping:        true,
+			Probe:       "wg",
+			PiaId:       "p1234",
+			PiaPassword: "secret",
+			Threads:     2,
+			Samples:     1,
+			SortOrder:   "asc",
+		},
+		pia: pia,
+	}
+	require.NoError(t, a.run())
+	require.Equal(t, 1, pia.auths)
+	require.ElementsMatch(t, []string{"token@a", "token@b", "token@c"}, pia.registered)
+}
+
+func TestWgProbeStopsAtDeadline(t *testing.T) {
+	pia := &wgProbePia{}
+	a := showRegionsAction{cmd: &ShowRegionsCmd{Probe: "wg"}, pia: pia, token: "token"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := a.probeTarget(ctx, piaclient.PiaRegion{Id: "a"})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, pia.registered)
+}
@@ -0,0 +1,179 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	"io"
+	stdos "os"
+	"strings"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/rotation"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type StatusCmd struct {
+	Interface   string        `help:"only show this wg device" placeholder:"NAME"`
+	Json        bool          `help:"print the devices as json"`
+	StaleAfter  time.Duration `help:"consider a session expired when its last handshake is older than this; wg re-handshakes every 2m while traffic flows" default:"3m"`
+	HistoryFile string        `help:"rotation history used to recognise devices whose server is no longer listed; defaults to the cache dir" placeholder:"FILE"`
+}
+
+// deviceStatus describes a wg device and, when it's connected to PIA, the region it's connected to
+type deviceStatus struct {
+	Device        string
+	Pia           bool
+	Region        string `json:",omitempty"`
+	RegionName    string `json:",omitempty"`
+	Endpoint      string `json:",omitempty"`
+	PublicKey     string
+	LastHandshake time.Time `json:",omitempty"`
+	ReceiveBytes  int64
+	TransmitBytes int64
+	Expired       bool
+}
+
+func (cmd *StatusCmd) Run(state *appstate.State) error {
+	mgr, err := wgdevice.New()
+	if err != nil {
+		return err
+	}
+	defer mgr.Close()
+	var devs []*wgtypes.Device
+	if len(cmd.Interface) > 0 {
+		dev, err := mgr.Device(cmd.Interface)
+		if err != nil {
+			return err
+		}
+		devs = append(devs, dev)
+	} else if devs, err = mgr.Devices(); err != nil {
+		return err
+	}
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	regions, err := pia.GetRegions()
+	if err != nil {
+		return err
+	}
+	var records []rotation.Record
+	if history := rotationHistory(cmd.HistoryFile, state); history != nil {
+		if records, err = history.Records(); err != nil {
+			log.Warning("unable to read rotation history", logging.KeyError, err)
+		}
+	}
+	statuses := inspectDevices(devs, regions, records, cmd.StaleAfter, time.Now())
+	if cmd.Json {
+		return printJson(stdos.Stdout, statuses)
+	}
+	writeDeviceStatuses(stdos.Stdout, statuses, time.Now())
+	return nil
+}
+
+// inspectDevices identifies the PIA devices, and their regions, by their peers' endpoints;
+// PIA doesn't list its servers' keys so a device whose server has since been dropped from the
+// server list is only recognised when its own key is in the rotation history
+func inspectDevices(devs []*wgtypes.Device, regions piaclient.PiaRegions, records []rotation.Record, staleAfter time.Duration, now time.Time) []deviceStatus {
+	statuses := make([]deviceStatus, 0, len(devs))
+	for _, dev := range devs {
+		status := deviceStatus{
+			Device:    dev.Name,
+			PublicKey: dev.PublicKey.String(),
+		}
+		var peer *wgtypes.Peer
+		for i := range dev.Peers {
+			p := &dev.Peers[i]
+			if p.Endpoint == nil {
+				continue
+			}
+			if region, err := regionForEndpoint(regions, p.Endpoint.IP.String()); err == nil {
+				peer = p
+				status.Pia = true
+				status.Region = region.Id
+				status.RegionName = region.Name
+				break
+			}
+		}
+		if peer == nil && len(dev.Peers) > 0 {
+			peer = &dev.Peers[0]
+			if r, ok := recordForKey(records, status.PublicKey); ok {
+				status.Pia = true
+				status.Region = r.Region
+				if region, err := findRegion(regions, r.Region); err == nil {
+					status.RegionName = region.Name
+				}
+			}
+		}
+		if peer != nil {
+			if peer.Endpoint != nil {
+				status.Endpoint = peer.Endpoint.String()
+			}
+			status.LastHandshake = peer.LastHandshakeTime
+			status.ReceiveBytes = peer.ReceiveBytes
+			status.TransmitBytes = peer.TransmitBytes
+		}
+		status.Expired = status.LastHandshake.IsZero() || now.Sub(status.LastHandshake) > staleAfter
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// recordForKey returns the latest successful rotation to the given client key
+func recordForKey(records []rotation.Record, key string) (rotation.Record, bool) {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].ClientPublicKey == key && len(records[i].Err) == 0 {
+			return records[i], true
+		}
+	}
+	return rotation.Record{}, false
+}
+
+func writeDeviceStatuses(out io.Writer, statuses []deviceStatus, now time.Time) {
+	fmt.Fprintf(out, "%-12s %-24s %-21s %-16s %10s %10s %-7s\n", "DEVICE", "REGION", "ENDPOINT", "HANDSHAKE", "RX", "TX", "STATE")
+	fmt.Fprintf(out, "%s\n", strings.Repeat("=", 106))
+	for _, s := range statuses {
+		region := s.RegionName
+		if !s.Pia {
+			region = "(not PIA)"
+		} else if len(region) == 0 {
+			region = s.Region
+		}
+		state := "ok"
+		if s.Expired {
+			state = "expired"
+		}
+		fmt.Fprintf(out, "%-12s %-24s %-21s %-16s %10s %10s %-7s\n", s.Device, region, s.Endpoint,
+			handshakeAge(s.LastHandshake, now), formatBytes(s.ReceiveBytes), formatBytes(s.TransmitBytes), state)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,107 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/rotation"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testDevice(t *testing.T, name string, endpoint string, handshake time.Time) *wgtypes.Device {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return &wgtypes.Device{
+		Name:      name,
+		PublicKey: key.PublicKey(),
+		Peers: []wgtypes.Peer{{
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP(endpoint), Port: 1337},
+			LastHandshakeTime: handshake,
+			ReceiveBytes:      2048,
+			TransmitBytes:     100,
+		}},
+	}
+}
+
+func TestInspectDevices(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	regions := piaclient.PiaRegions{Regions: []piaclient.PiaRegion{
+		{Id: "ca_toronto", Name: "CA Toronto", Servers: piaclient.PiaServers{Wg: []piaclient.PiaServer{{Ip: "192.0.2.1"}}}},
+		{Id: "ca_montreal", Name: "CA Montreal", Servers: piaclient.PiaServers{Wg: []piaclient.PiaServer{{Ip: "192.0.2.2"}}}},
+	}}
+	listed := testDevice(t, "pia", "192.0.2.2", now.Add(-time.Minute))
+	other := testDevice(t, "home", "198.51.100.1", now.Add(-time.Minute))
+	// its server has since been dropped from the list but it was put there by a rotation
+	rotated := testDevice(t, "pia2", "192.0.2.9", now.Add(-time.Hour))
+	records := []rotation.Record{
+		{Region: "ca_montreal", ClientPublicKey: rotated.PublicKey.String(), Err: "addKey failed"},
+		{Region: "ca_toronto", ClientPublicKey: rotated.PublicKey.String()},
+	}
+
+	statuses := inspectDevices([]*wgtypes.Device{listed, other, rotated}, regions, records, 3*time.Minute, now)
+	require.Len(t, statuses, 3)
+	require.Equal(t, deviceStatus{
+		Device:        "pia",
+		Pia:           true,
+		Region:        "ca_montreal",
+		RegionName:    "CA Montreal",
+		Endpoint:      "192.0.2.2:1337",
+		PublicKey:     listed.PublicKey.String(),
+		LastHandshake: now.Add(-time.Minute),
+		ReceiveBytes:  2048,
+		TransmitBytes: 100,
+	}, statuses[0])
+	require.False(t, statuses[1].Pia)
+	require.Empty(t, statuses[1].Region)
+	require.True(t, statuses[2].Pia)
+	require.Equal(t, "CA Toronto", statuses[2].RegionName)
+	require.True(t, statuses[2].Expired)
+}
+
+func TestInspectDevicesWithoutPeers(t *testing.T) {
+	statuses := inspectDevices([]*wgtypes.Device{{Name: "wg0"}}, piaclient.PiaRegions{}, nil, time.Minute, time.Now())
+	require.Len(t, statuses, 1)
+	require.False(t, statuses[0].Pia)
+	require.True(t, statuses[0].Expired)
+}
+
+func TestWriteDeviceStatuses(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	writeDeviceStatuses(&out, []deviceStatus{
+		{Device: "pia", Pia: true, Region: "ca_toronto", RegionName: "CA Toronto", Endpoint: "192.0.2.1:1337", LastHandshake: now.Add(-time.Minute), ReceiveBytes: 3 << 20},
+		{Device: "home", Expired: true},
+	}, now)
+	lines := strings.Split(out.String(), "\n")
+	require.Regexp(t, `^pia +CA Toronto +192\.0\.2\.1:1337 +1m0s ago +3\.0 MiB +0 B ok`, lines[2])
+	require.Regexp(t, `^home +\(not PIA\) +never .* expired`, lines[3])
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "0 B", formatBytes(0))
+	require.Equal(t, "1023 B", formatBytes(1023))
+	require.Equal(t, "1.5 KiB", formatBytes(1536))
+	require.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
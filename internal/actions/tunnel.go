@@ -0,0 +1,101 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+)
+
+// autoRegion is the --pia-region-id that picks the reachable region with the lowest latency
+const autoRegion = "auto"
+
+// wgConfig binds a tunnel, and what's sent through it, to the wg config template
+type wgConfig struct {
+	piaclient.PiaInterface
+	AllowedIps []string
+	KillSwitch bool
+}
+
+// newWgConfig returns the bindings of a config sending cidrs, or all traffic when there are none,
+// through the given tunnel
+func newWgConfig(iface piaclient.PiaInterface, cidrs []net.IPNet, killSwitch bool) wgConfig {
+	cfg := wgConfig{PiaInterface: iface, KillSwitch: killSwitch}
+	for _, c := range wgdevice.TunnelAllowedIps(iface, cidrs, true) {
+		cfg.AllowedIps = append(cfg.AllowedIps, c.String())
+	}
+	return cfg
+}
+
+// parseAllowedIps parses the cidrs given to --allowed-ips
+func parseAllowedIps(cidrs []string) ([]net.IPNet, error) {
+	var allowed []net.IPNet
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil || cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid --allowed-ips cidr: %s", c)
+		}
+		allowed = append(allowed, *cidr)
+	}
+	return allowed, nil
+}
+
+// pickRegion returns the id of the region to connect to: id itself or, when it's auto, the reachable
+// region with the lowest latency among those whose name or id contains match
+func pickRegion(ctx context.Context, pia piaclient.PiaClient, id string, match string) (string, error) {
+	if id != autoRegion {
+		return id, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	all, err := pia.GetRegions()
+	if err != nil {
+		return "", err
+	}
+	candidates := matchingRegions(all, match)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no regions match %s", match)
+	}
+	log.V(1).Info("picking the region with the lowest latency", "count", len(candidates))
+	ranked := rankRegions(ctx, candidates, newPinger("icmp", os.DefaultTimeout))
+	if len(ranked) == 0 {
+		return "", fmt.Errorf("none of the %d candidate regions answered a ping", len(candidates))
+	}
+	log.Info("picked the region with the lowest latency", logging.KeyRegion, ranked[0])
+	return ranked[0], nil
+}
+
+// matchingRegions returns the regions whose name or id contains search, ignoring case
+func matchingRegions(all piaclient.PiaRegions, search string) []piaclient.PiaRegion {
+	search = strings.ToLower(search)
+	var matches []piaclient.PiaRegion
+	for _, r := range all.Regions {
+		if strings.Contains(strings.ToLower(r.Name), search) || strings.Contains(strings.ToLower(r.Id), search) {
+			matches = append(matches, r)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,110 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gitlab.com/ddb_db/piawgcli/internal/appstate"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+)
+
+type UpCmd struct {
+	Interface    string   `help:"name of the wg device to create or reconfigure" default:"pia" placeholder:"NAME"`
+	Config       string   `help:"bring up the tunnel in this wg config, created by create-config, instead of creating a new one" placeholder:"FILE" xor:"source"`
+	PiaId        string   `help:"PIA user id" env:"PIA_ID" placeholder:"ID"`
+	PiaPassword  string   `help:"PIA password" env:"PIA_PASSWORD" placeholder:"PWD"`
+	PiaRegionId  string   `help:"PIA region id to connect to; use show-regions command to get the region id, or auto for the region with the lowest latency" placeholder:"ID" xor:"source"`
+	AutoRegion   string   `help:"with --pia-region-id auto, only consider the regions whose name or id contains SEARCH" placeholder:"SEARCH"`
+	IgnorePiaDns bool     `help:"do not set DNS servers to PIA servers"`
+	AllowedIps   []string `help:"send only these cidrs through the tunnel (split tunnelling) instead of all traffic" default:"0.0.0.0/0" placeholder:"CIDR,..."`
+	NoRoutes     bool     `help:"do not route the allowed ips through the tunnel; the server virtual ip still is"`
+	KillSwitch   bool     `help:"reject traffic that doesn't go through the tunnel until it's taken down with the down command; needs iptables"`
+}
+
+type DownCmd struct {
+	Interface string `help:"name of the wg device to remove" default:"pia" placeholder:"NAME"`
+}
+
+func (cmd *UpCmd) Run(state *appstate.State) error {
+	allowed, err := parseAllowedIps(cmd.AllowedIps)
+	if err != nil {
+		return err
+	}
+	iface, err := cmd.tunnel(state)
+	if err != nil {
+		return err
+	}
+	mgr, err := wgdevice.New()
+	if err != nil {
+		return err
+	}
+	defer mgr.Close()
+	opts := wgdevice.Options{
+		Routes:     !cmd.NoRoutes,
+		Dns:        !cmd.IgnorePiaDns,
+		AllowedIps: allowed,
+		KillSwitch: cmd.KillSwitch,
+	}
+	if err = mgr.Up(cmd.Interface, iface, opts); err != nil {
+		return err
+	}
+	fmt.Printf("%s is up: %s -> %s:%d\n", cmd.Interface, iface.ClientIp, iface.ServerEndpoint, iface.ServerPort)
+	return nil
+}
+
+// tunnel returns the tunnel to bring up, either read from the given config or newly created
+func (cmd *UpCmd) tunnel(state *appstate.State) (piaclient.PiaInterface, error) {
+	if len(cmd.Config) > 0 {
+		data, err := ioutil.ReadFile(cmd.Config)
+		if err != nil {
+			return piaclient.PiaInterface{}, err
+		}
+		iface, _, err := parseWgConfig(string(data))
+		if err != nil {
+			return piaclient.PiaInterface{}, fmt.Errorf("%s: %w", cmd.Config, err)
+		}
+		return iface, nil
+	}
+	if len(cmd.PiaId) == 0 || len(cmd.PiaPassword) == 0 || len(cmd.PiaRegionId) == 0 {
+		return piaclient.PiaInterface{}, fmt.Errorf("either --config or all of --pia-id, --pia-password and --pia-region-id are required")
+	}
+	pia := piaclient.NewWithOptions(state.ServerList, state.PiaOptions)
+	regionId, err := pickRegion(state.Context, pia, cmd.PiaRegionId, cmd.AutoRegion)
+	if err != nil {
+		return piaclient.PiaInterface{}, err
+	}
+	log.V(1).Info("creating tunnel", "interface", cmd.Interface, logging.KeyRegion, regionId)
+	return pia.CreateTunnel(cmd.PiaId, cmd.PiaPassword, regionId)
+}
+
+func (cmd *DownCmd) Run(state *appstate.State) error {
+	mgr, err := wgdevice.New()
+	if err != nil {
+		return err
+	}
+	defer mgr.Close()
+	if err = mgr.Down(cmd.Interface); err != nil {
+		return err
+	}
+	fmt.Printf("%s is down\n", cmd.Interface)
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+// readWgConfig rebuilds the PIA interface described by a wg config file written by create-config;
+// the region details are looked up in the PIA server list
+func readWgConfig(path string, pia piaclient.PiaClient) (piaclient.PiaInterface, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return piaclient.PiaInterface{}, err
+	}
+	iface, regionId, err := parseWgConfig(string(data))
+	if err != nil {
+		return piaclient.PiaInterface{}, fmt.Errorf("%s: %w", path, err)
+	}
+	regions, err := pia.GetRegions()
+	if err != nil {
+		return piaclient.PiaInterface{}, err
+	}
+	region, err := findRegion(regions, regionId)
+	if err != nil {
+		return piaclient.PiaInterface{}, err
+	}
+	iface.PiaRegion = region
+	for _, s := range region.Servers.Wg {
+		if s.Ip == iface.ServerEndpoint {
+			iface.ServerCn = s.Cn
+		}
+	}
+	if len(iface.ServerCn) == 0 {
+		return piaclient.PiaInterface{}, fmt.Errorf("wg server %s is no longer listed for region %s", iface.ServerEndpoint, regionId)
+	}
+	return iface, nil
+}
+
+// parseWgConfig extracts the interface details, and the PIA region id, from the given wg config
+func parseWgConfig(config string) (piaclient.PiaInterface, string, error) {
+	iface := piaclient.PiaInterface{}
+	var regionId string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			// create-config records the PIA details wg-quick doesn't need in comments
+			key, val := splitWgConfigLine(strings.TrimLeft(line, "# "), ":")
+			switch key {
+			case "Peer":
+				regionId = strings.SplitN(val, "/", 2)[0]
+			case "ServerVirtualIP":
+				iface.ServerVirtualIp = val
+			case "ClientPublicKey":
+				iface.ClientPublicKey = val
+			}
+			continue
+		}
+		key, val := splitWgConfigLine(line, "=")
+		switch key {
+		case "PrivateKey":
+			iface.ClientPrivateKey = val
+		case "Address":
+			iface.ClientIp = strings.SplitN(val, "/", 2)[0]
+		case "DNS":
+			for _, dns := range strings.Split(val, ",") {
+				iface.DnsServers = append(iface.DnsServers, strings.TrimSpace(dns))
+			}
+		case "PublicKey":
+			iface.ServerPublicKey = val
+		case "Endpoint":
+			host, port, err := net.SplitHostPort(val)
+			if err != nil {
+				return iface, "", fmt.Errorf("invalid endpoint: %w", err)
+			}
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return iface, "", fmt.Errorf("invalid endpoint port: %w", err)
+			}
+			iface.ServerEndpoint = host
+			iface.ServerPort = uint16(p)
+		}
+	}
+	if len(regionId) == 0 || len(iface.ServerVirtualIp) == 0 || len(iface.ServerEndpoint) == 0 {
+		return iface, "", fmt.Errorf("not a wg config created by piawgcli")
+	}
+	return iface, regionId, nil
+}
+
+// parseWgConfigRouting extracts what the given wg config, written by create-config, sends through the
+// tunnel, less the virtual ip and dns servers create-config adds for the tunnel itself, and whether it
+// has a kill switch
+func parseWgConfigRouting(config string) ([]net.IPNet, bool) {
+	iface, _, _ := parseWgConfig(config)
+	own := map[string]bool{iface.ServerVirtualIp + "/32": true}
+	for _, dns := range iface.DnsServers {
+		own[dns+"/32"] = true
+	}
+	var allowed []net.IPNet
+	killSwitch := false
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, val := splitWgConfigLine(strings.TrimSpace(scanner.Text()), "=")
+		switch key {
+		case "AllowedIPs":
+			for _, c := range strings.Split(val, ",") {
+				_, cidr, err := net.ParseCIDR(strings.TrimSpace(c))
+				if err == nil && !own[cidr.String()] {
+					allowed = append(allowed, *cidr)
+				}
+			}
+		case "PostUp":
+			killSwitch = killSwitch || strings.HasPrefix(val, "iptables -I OUTPUT ! -o %i ")
+		}
+	}
+	return allowed, killSwitch
+}
+
+func splitWgConfigLine(line string, sep string) (string, string) {
+	parts := strings.SplitN(line, sep, 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+func findRegion(regions piaclient.PiaRegions, id string) (piaclient.PiaRegion, error) {
+	for _, r := range regions.Regions {
+		if r.Id == id {
+			return r, nil
+		}
+	}
+	return piaclient.PiaRegion{}, fmt.Errorf("unknown region id: %s", id)
+}
+
+// regionForEndpoint finds the region that has a wg server at the given ip
+func regionForEndpoint(regions piaclient.PiaRegions, ip string) (piaclient.PiaRegion, error) {
+	for _, r := range regions.Regions {
+		for _, s := range r.Servers.Wg {
+			if s.Ip == ip {
+				return r, nil
+			}
+		}
+	}
+	return piaclient.PiaRegion{}, fmt.Errorf("wg server %s is not listed in any region", ip)
+}
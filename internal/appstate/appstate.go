@@ -17,7 +17,16 @@
 */
 package appstate
 
+import (
+	"context"
+
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
 type State struct {
 	ServerList string
 	Debug      uint8
+	PiaOptions piaclient.Options
+	// Context is cancelled when the user interrupts the program
+	Context context.Context
 }
@@ -0,0 +1,199 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// the global flags that select the config file and profile
+const (
+	fileFlag    = "config-file"
+	profileFlag = "profile"
+)
+
+// File is a config file of named profiles; a profile maps flag names to values, for any
+// command, and can hold a section per command for flags that only apply to that command:
+//
+//	default-profile: office
+//	profiles:
+//	  office:
+//	    pia-id: p1234567
+//	    pia-password-file: /etc/piawgcli/office.pass
+//	    pia-region-id: ca_toronto
+//	    create-config:
+//	      output: office.conf
+type File struct {
+	DefaultProfile string             `yaml:"default-profile"`
+	Profiles       map[string]Profile `yaml:"profiles"`
+}
+
+type Profile map[string]interface{}
+
+// DefaultPath is where the config file is read from when no other file is given
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "piawgcli", "config.yaml")
+}
+
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err = yaml.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Profile returns the named profile, or the default profile when name is empty; it's nil when
+// no name is given and there's no default
+func (f *File) Profile(name string) (Profile, error) {
+	if len(name) == 0 {
+		name = f.DefaultProfile
+		if len(name) == 0 {
+			return nil, nil
+		}
+	}
+	p, ok := f.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	return p, nil
+}
+
+// lookup returns the profile's value for the given flag of the given command; a value in the
+// command's own section wins over one for all commands
+func (p Profile) lookup(command string, flag string) (interface{}, bool) {
+	if section, ok := asSection(p[command]); ok && len(command) > 0 {
+		if v, ok := section[flag]; ok {
+			return v, true
+		}
+	}
+	v, ok := p[flag]
+	if _, section := asSection(v); section {
+		// a command's section, i.e. port-forward, rather than the flag of the same name
+		return nil, false
+	}
+	return v, ok
+}
+
+func asSection(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case Profile:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
+
+// NewResolver returns a resolver that fills in flags not given on the command line from the
+// profile selected by the --config-file and --profile flags; flags set through their env var
+// are left alone so the precedence is flags, env vars, profile and then defaults
+func NewResolver(ctx *kong.Context) (kong.Resolver, error) {
+	profile, err := selectedProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var f kong.ResolverFunc = func(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		if profile == nil || flag.Name == fileFlag || flag.Name == profileFlag {
+			return nil, nil
+		}
+		if len(flag.Env) > 0 {
+			if _, ok := os.LookupEnv(flag.Env); ok {
+				return nil, nil
+			}
+		}
+		command := ""
+		if parent.Command != nil {
+			command = parent.Command.Name
+		}
+		v, ok := profile.lookup(command, flag.Name)
+		if !ok && flag.Name == "pia-password" {
+			// keeps the password itself out of the config file
+			if path, ok := profile.lookup(command, "pia-password-file"); ok {
+				data, err := ioutil.ReadFile(fmt.Sprint(path))
+				if err != nil {
+					return nil, err
+				}
+				return strings.TrimSpace(string(data)), nil
+			}
+		}
+		if !ok || v == nil {
+			return nil, nil
+		}
+		return flagValue(v), nil
+	}
+	return f, nil
+}
+
+func selectedProfile(ctx *kong.Context) (Profile, error) {
+	var path, name string
+	for _, flag := range ctx.Flags() {
+		switch flag.Name {
+		case fileFlag:
+			path, _ = ctx.FlagValue(flag).(string)
+		case profileFlag:
+			name, _ = ctx.FlagValue(flag).(string)
+		}
+	}
+	explicit := len(path) > 0
+	if !explicit {
+		path = DefaultPath()
+	}
+	f, err := Load(kong.ExpandPath(path))
+	if os.IsNotExist(err) && !explicit {
+		if len(name) > 0 {
+			return nil, fmt.Errorf("profile %s requested but there is no config file at %s", name, path)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.Profile(name)
+}
+
+// flagValue converts a yaml value to one kong's mappers accept
+func flagValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = fmt.Sprint(e)
+		}
+		return values
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+default-profile: office
+profiles:
+  office:
+    pia-id: p1234567
+    pia-password-file: %PASSFILE%
+    region: ca_toronto
+    regions: [ca_montreal, ca_ontario]
+    ignore-dns: true
+    interval: 45s
+    connect:
+      region: ca_vancouver
+  home:
+    pia-id: p7654321
+    pia-password: hunter2
+    port-forward:
+      interval: 1m
+`
+
+type testConnectCmd struct {
+	PiaId       string        `required env:"PIAWGCLI_TEST_ID"`
+	PiaPassword string        `required`
+	Region      string        `default:"us_texas"`
+	Regions     []string      ``
+	IgnoreDns   bool          ``
+	Interval    time.Duration `default:"30s"`
+	PortForward bool          ``
+}
+
+func (cmd *testConnectCmd) Run() error {
+	return nil
+}
+
+type testCli struct {
+	ConfigFile string
+	Profile    string
+	Connect    testConnectCmd `cmd`
+}
+
+func (c *testCli) BeforeResolve(ctx *kong.Context) error {
+	r, err := NewResolver(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(r)
+	return nil
+}
+
+func writeConfig(t *testing.T) string {
+	dir := t.TempDir()
+	pass := filepath.Join(dir, "pass")
+	require.NoError(t, ioutil.WriteFile(pass, []byte("s3cret\n"), 0600))
+	path := filepath.Join(dir, "config.yaml")
+	cfg := []byte(strings.ReplaceAll(testConfig, "%PASSFILE%", pass))
+	require.NoError(t, ioutil.WriteFile(path, cfg, 0600))
+	return path
+}
+
+func parse(t *testing.T, args ...string) (*testCli, error) {
+	cli := &testCli{}
+	parser, err := kong.New(cli, kong.Exit(func(int) { t.Fatal("exited") }))
+	require.NoError(t, err)
+	_, err = parser.Parse(args)
+	return cli, err
+}
+
+func TestProfileFillsInFlags(t *testing.T) {
+	path := writeConfig(t)
+	cli, err := parse(t, "--config-file", path, "connect")
+	require.NoError(t, err)
+	require.Equal(t, testConnectCmd{
+		PiaId:       "p1234567",
+		PiaPassword: "s3cret",
+		Region:      "ca_vancouver",
+		Regions:     []string{"ca_montreal", "ca_ontario"},
+		IgnoreDns:   true,
+		Interval:    45 * time.Second,
+	}, cli.Connect)
+}
+
+func TestProfilePrecedence(t *testing.T) {
+	path := writeConfig(t)
+	require.NoError(t, os.Setenv("PIAWGCLI_TEST_ID", "p0000000"))
+	defer os.Unsetenv("PIAWGCLI_TEST_ID")
+	cli, err := parse(t, "--config-file", path, "connect", "--region", "us_florida")
+	require.NoError(t, err)
+	require.Equal(t, "us_florida", cli.Connect.Region)
+	require.Equal(t, "p0000000", cli.Connect.PiaId)
+}
+
+func TestNamedProfile(t *testing.T) {
+	path := writeConfig(t)
+	cli, err := parse(t, "--config-file", path, "--profile", "home", "connect")
+	require.NoError(t, err)
+	require.Equal(t, "p7654321", cli.Connect.PiaId)
+	require.Equal(t, "hunter2", cli.Connect.PiaPassword)
+	// defaults still apply and the port-forward section isn't mistaken for the flag
+	require.Equal(t, "us_texas", cli.Connect.Region)
+	require.False(t, cli.Connect.PortForward)
+
+	_, err = parse(t, "--config-file", path, "--profile", "work", "connect")
+	require.EqualError(t, err, "unknown profile: work")
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	_, err := parse(t, "--config-file", filepath.Join(t.TempDir(), "nope.yaml"), "connect")
+	require.Error(t, err)
+}
@@ -0,0 +1,100 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+)
+
+// Client talks to a daemon's control socket
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	dialer := net.Dialer{}
+	return &Client{
+		http: &http.Client{
+			// re-registering a tunnel can take a while so this is generous
+			Timeout: 2 * time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Status() (monitor.Status, error) {
+	var status monitor.Status
+	return status, c.do(http.MethodGet, "/status", &status)
+}
+
+func (c *Client) Reconnect() (monitor.Status, error) {
+	var status monitor.Status
+	return status, c.do(http.MethodPost, "/reconnect", &status)
+}
+
+func (c *Client) SwitchRegion(id string) (monitor.Status, error) {
+	var status monitor.Status
+	return status, c.do(http.MethodPost, "/switch-region/"+url.PathEscape(id), &status)
+}
+
+func (c *Client) RotateKey() (monitor.Status, error) {
+	var status monitor.Status
+	return status, c.do(http.MethodPost, "/rotate-key", &status)
+}
+
+func (c *Client) Port() (Port, error) {
+	var port Port
+	return port, c.do(http.MethodGet, "/port", &port)
+}
+
+func (c *Client) do(method string, path string, result interface{}) error {
+	req, err := http.NewRequest(method, "http://piawgcli"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach the daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if json.Unmarshal(body, &errResp) == nil && len(errResp.Error) > 0 {
+			return fmt.Errorf("%s", errResp.Error)
+		}
+		return fmt.Errorf("unexpected response from the daemon [%d]", resp.StatusCode)
+	}
+	return json.Unmarshal(body, result)
+}
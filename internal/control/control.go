@@ -0,0 +1,45 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package control
+
+import (
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+)
+
+// Daemon is what the control api controls
+type Daemon interface {
+	Status() monitor.Status
+	Reconnect() error
+	SwitchRegion(id string) error
+	RotateKey() error
+	// Port returns the forwarded port; ok is false when the daemon isn't forwarding a port
+	Port() (port Port, ok bool)
+}
+
+// Port is the port the daemon is currently forwarding
+type Port struct {
+	Port      uint16
+	ExpiresAt time.Time
+}
+
+// errorResponse is the body of every failed request
+type errorResponse struct {
+	Error string
+}
@@ -0,0 +1,146 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/monitor"
+)
+
+type fakeDaemon struct {
+	region     string
+	reconnects int
+	rotations  int
+	port       Port
+}
+
+func (d *fakeDaemon) Status() monitor.Status {
+	return monitor.Status{Interface: "pia", Connected: true, Region: d.region}
+}
+
+func (d *fakeDaemon) Reconnect() error {
+	d.reconnects++
+	return nil
+}
+
+func (d *fakeDaemon) SwitchRegion(id string) error {
+	if id == "nowhere" {
+		return errors.New("unknown region: nowhere")
+	}
+	d.region = id
+	return nil
+}
+
+func (d *fakeDaemon) RotateKey() error {
+	d.rotations++
+	return nil
+}
+
+func (d *fakeDaemon) Port() (Port, bool) {
+	return d.port, d.port.Port > 0
+}
+
+func serve(t *testing.T, d Daemon) string {
+	path := filepath.Join(t.TempDir(), "piawgcli.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, Serve(ctx, path, SocketOptions{Mode: 0600}, d))
+	return path
+}
+
+func TestControl(t *testing.T) {
+	d := &fakeDaemon{region: "ca_toronto"}
+	clnt := NewClient(serve(t, d))
+
+	status, err := clnt.Status()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", status.Region)
+
+	_, err = clnt.Reconnect()
+	require.NoError(t, err)
+	require.Equal(t, 1, d.reconnects)
+
+	status, err = clnt.SwitchRegion("ca_montreal")
+	require.NoError(t, err)
+	require.Equal(t, "ca_montreal", status.Region)
+	_, err = clnt.SwitchRegion("nowhere")
+	require.EqualError(t, err, "unknown region: nowhere")
+
+	_, err = clnt.RotateKey()
+	require.NoError(t, err)
+	require.Equal(t, 1, d.rotations)
+}
+
+func TestControlPort(t *testing.T) {
+	d := &fakeDaemon{}
+	clnt := NewClient(serve(t, d))
+	_, err := clnt.Port()
+	require.EqualError(t, err, "no port is being forwarded")
+
+	d.port = Port{Port: 43210, ExpiresAt: time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)}
+	port, err := clnt.Port()
+	require.NoError(t, err)
+	require.Equal(t, d.port, port)
+}
+
+func TestControlRequiresMethod(t *testing.T) {
+	clnt := NewClient(serve(t, &fakeDaemon{}))
+	err := clnt.do(http.MethodGet, "/reconnect", nil)
+	require.EqualError(t, err, "/reconnect requires POST")
+}
+
+func TestControlSocket(t *testing.T) {
+	path := serve(t, &fakeDaemon{})
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a live socket isn't taken over...
+	require.Error(t, Serve(context.Background(), path, SocketOptions{Mode: 0600}, &fakeDaemon{}))
+
+	// ...but one left behind is
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	require.NoError(t, err)
+	l.SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, Serve(ctx, stale, SocketOptions{Mode: 0660}, &fakeDaemon{}))
+	info, err = os.Stat(stale)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket, info.Mode().Type())
+}
+
+func TestControlSocketWontReplaceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pia.conf")
+	require.NoError(t, os.WriteFile(path, []byte("[Interface]\n"), 0600))
+	require.Error(t, Serve(context.Background(), path, SocketOptions{Mode: 0600}, &fakeDaemon{}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "[Interface]\n", string(data))
+}
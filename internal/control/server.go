@@ -0,0 +1,163 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+var log = logging.Component("control")
+
+// SocketOptions control who may use the control socket; anyone who can connect to it can
+// control the daemon
+type SocketOptions struct {
+	Mode  os.FileMode
+	Group string // optional; name or gid of the group to give the socket to
+}
+
+// Serve answers control requests for d on the unix socket at path until ctx is cancelled
+func Serve(ctx context.Context, path string, opts SocketOptions, d Daemon) error {
+	l, err := listen(path, opts)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: newHandler(d)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.V(1).Info("control api listening", "path", path)
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error(err, "control api failed")
+		}
+	}()
+	return nil
+}
+
+func listen(path string, opts SocketOptions) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		// a socket left behind by a daemon that didn't shut down cleanly is replaced, a live one isn't
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use; is the daemon already running?", path)
+		}
+		// anything else at the path is left alone, it's likely a mistake in --control-socket
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, opts.Mode); err == nil && len(opts.Group) > 0 {
+		var gid int
+		if gid, err = lookupGid(opts.Group); err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to set permissions of %s: %w", path, err)
+	}
+	return l, nil
+}
+
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+func newHandler(d Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", only(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, d.Status())
+	}))
+	mux.HandleFunc("/reconnect", only(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		replyResult(w, d.Reconnect(), d)
+	}))
+	mux.HandleFunc("/switch-region/", only(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/switch-region/")
+		if len(id) == 0 {
+			reply(w, http.StatusBadRequest, errorResponse{"region id is required"})
+			return
+		}
+		replyResult(w, d.SwitchRegion(id), d)
+	}))
+	mux.HandleFunc("/rotate-key", only(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		replyResult(w, d.RotateKey(), d)
+	}))
+	mux.HandleFunc("/port", only(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		port, ok := d.Port()
+		if !ok {
+			reply(w, http.StatusNotFound, errorResponse{"no port is being forwarded"})
+			return
+		}
+		reply(w, http.StatusOK, port)
+	}))
+	return mux
+}
+
+func only(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			reply(w, http.StatusMethodNotAllowed, errorResponse{fmt.Sprintf("%s requires %s", r.URL.Path, method)})
+			return
+		}
+		log.V(4).Info("control request", "method", r.Method, "path", r.URL.Path)
+		h(w, r)
+	}
+}
+
+// replyResult answers an action with the resulting status, or the error it failed with
+func replyResult(w http.ResponseWriter, err error, d Daemon) {
+	if err != nil {
+		reply(w, http.StatusInternalServerError, errorResponse{err.Error()})
+		return
+	}
+	reply(w, http.StatusOK, d.Status())
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error(err, "unable to write control response")
+	}
+}
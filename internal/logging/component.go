@@ -0,0 +1,146 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// the fields every component logs the same way
+const (
+	KeyComponent = "component" // piaclient, pinger, actions...
+	KeyRegion    = "region"    // PIA region id
+	KeyDuration  = "duration"  // how long a request or probe took; seconds in json
+	KeyError     = "err"
+)
+
+// Logger logs the messages of one component through klog, tagged with the component's name
+type Logger struct {
+	values []interface{}
+}
+
+// Component returns the logger of the named component
+func Component(name string) Logger {
+	return Logger{values: []interface{}{KeyComponent, name}}
+}
+
+// WithValues returns a logger that adds the given keys and values to every message
+func (l Logger) WithValues(keysAndValues ...interface{}) Logger {
+	return Logger{values: append(append([]interface{}{}, l.values...), keysAndValues...)}
+}
+
+// WithRegion returns a logger that tags every message with the region id
+func (l Logger) WithRegion(id string) Logger {
+	return l.WithValues(KeyRegion, id)
+}
+
+type regionKey struct{}
+
+// WithRegionContext returns a copy of ctx that carries the id of the region being worked on
+func WithRegionContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, regionKey{}, id)
+}
+
+// ForContext returns a logger that tags every message with the region carried by ctx, if any
+func (l Logger) ForContext(ctx context.Context) Logger {
+	if id, ok := ctx.Value(regionKey{}).(string); ok {
+		return l.WithRegion(id)
+	}
+	return l
+}
+
+func (l Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(0, "info", nil, msg, keysAndValues)
+}
+
+func (l Logger) Warning(msg string, keysAndValues ...interface{}) {
+	l.log(0, "warning", nil, msg, keysAndValues)
+}
+
+func (l Logger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.log(0, "error", err, msg, keysAndValues)
+}
+
+// V returns a logger for messages that are only logged at verbosity level and up
+func (l Logger) V(level klog.Level) Verbose {
+	return Verbose{l: l, level: level, enabled: klog.V(level).Enabled()}
+}
+
+// Verbose is a Logger for messages logged at a verbosity level
+type Verbose struct {
+	l       Logger
+	level   klog.Level
+	enabled bool
+}
+
+func (v Verbose) Enabled() bool {
+	return v.enabled
+}
+
+func (v Verbose) Info(msg string, keysAndValues ...interface{}) {
+	if v.enabled {
+		v.l.log(v.level, "info", nil, msg, keysAndValues)
+	}
+}
+
+func (l Logger) log(level klog.Level, severity string, err error, msg string, keysAndValues []interface{}) {
+	kv := append(append([]interface{}{}, l.values...), keysAndValues...)
+	if sink := currentJsonLogger(); sink != nil {
+		// straight to the sink; klog would drop the verbosity of InfoSDepth and has no structured warnings
+		sink.v = int(level)
+		sink.write(severity, err, msg, kv)
+		return
+	}
+	if err != nil {
+		kv = append(kv, KeyError, err)
+	}
+	// depth 2 skips this and the exported method so klog's header has the caller's file and line
+	switch severity {
+	case "error":
+		klog.ErrorDepth(2, formatText(msg, kv))
+	case "warning":
+		klog.WarningDepth(2, formatText(msg, kv))
+	default:
+		klog.InfoDepth(2, formatText(msg, kv))
+	}
+}
+
+// formatText formats a message as its text followed by key=value pairs; unlike klog's InfoS the
+// message isn't quoted so multi-line messages, like resty's request dumps, stay readable
+func formatText(msg string, keysAndValues []interface{}) string {
+	b := &bytes.Buffer{}
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var v interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			v = keysAndValues[i+1]
+		}
+		s := fmt.Sprintf("%+v", v)
+		if len(s) == 0 || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(b, " %s=%s", keysAndValues[i], s)
+	}
+	return b.String()
+}
@@ -0,0 +1,136 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// keys whose values are always redacted
+var secretKey = regexp.MustCompile(`(?i)^(token|pt|password|pwd|private_?key|signature|authorization)$`)
+
+// jsonLogger is a logr sink that writes each message as a line of json
+type jsonLogger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	v      int
+	name   string
+	values []interface{}
+}
+
+// NewJsonLogger returns a logr sink that writes json lines to out; every string in them is redacted
+func NewJsonLogger(out io.Writer) logr.Logger {
+	return jsonLogger{out: out, lock: &sync.Mutex{}}
+}
+
+// Enabled is always true; klog decides what's logged
+func (l jsonLogger) Enabled() bool {
+	return true
+}
+
+func (l jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.write("info", nil, msg, keysAndValues)
+}
+
+func (l jsonLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.write("error", err, msg, keysAndValues)
+}
+
+func (l jsonLogger) V(level int) logr.Logger {
+	l.v = level
+	return l
+}
+
+func (l jsonLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	l.values = append(append([]interface{}{}, l.values...), keysAndValues...)
+	return l
+}
+
+func (l jsonLogger) WithName(name string) logr.Logger {
+	if len(l.name) > 0 {
+		name = l.name + "." + name
+	}
+	l.name = name
+	return l
+}
+
+func (l jsonLogger) write(level string, err error, msg string, keysAndValues []interface{}) {
+	entry := map[string]interface{}{
+		"ts":    time.Now().Format(time.RFC3339Nano),
+		"level": level,
+		"v":     l.v,
+		// messages from klog's printf style functions keep their trailing newline
+		"msg": Redact(strings.TrimSpace(msg)),
+	}
+	if len(l.name) > 0 {
+		entry[KeyComponent] = l.name
+	}
+	if err != nil {
+		entry[KeyError] = Redact(err.Error())
+	}
+	kv := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var val interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			val = kv[i+1]
+		}
+		if secretKey.MatchString(key) {
+			val = Redacted
+		}
+		entry[key] = jsonValue(val)
+	}
+	data, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		data, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": Redact(fmt.Sprintf("unable to log %q: %v", msg, jsonErr))})
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// jsonValue returns v as it should appear in the log; durations are in seconds
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return val
+	case time.Duration:
+		return val.Seconds()
+	case string:
+		return Redact(val)
+	case error:
+		return Redact(val.Error())
+	case []string:
+		redacted := make([]string, len(val))
+		for i, s := range val {
+			redacted[i] = Redact(s)
+		}
+		return redacted
+	case fmt.Stringer:
+		return Redact(val.String())
+	}
+	return Redact(fmt.Sprintf("%+v", v))
+}
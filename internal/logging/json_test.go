@@ -0,0 +1,110 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+)
+
+// logJson logs through klog and the component loggers as json and returns the decoded lines
+func logJson(t *testing.T, verbosity int, log func()) []map[string]interface{} {
+	var buf bytes.Buffer
+	Init(&buf, verbosity, FormatJson)
+	defer Init(&bytes.Buffer{}, 0, FormatText)
+	log()
+	klog.Flush()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		require.NotEmpty(t, entry["ts"])
+		delete(entry, "ts")
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestJsonComponentFields(t *testing.T) {
+	lines := logJson(t, 4, func() {
+		log := Component("piaclient")
+		log.WithRegion("ca_toronto").V(4).Info("pia request", "request", "addKey", KeyDuration, 1500*time.Millisecond)
+		log.V(5).Info("too verbose")
+		log.Warning("unable to cache server list", KeyError, errors.New("disk full"))
+		ctx := WithRegionContext(context.Background(), "us_east")
+		Component("pinger").ForContext(ctx).Error(errors.New("no replies received"), "ping failed", "host", "10.0.0.1")
+	})
+	require.Equal(t, []map[string]interface{}{
+		{"level": "info", "v": 4.0, "msg": "pia request", "component": "piaclient", "region": "ca_toronto", "request": "addKey", "duration": 1.5},
+		{"level": "warning", "v": 0.0, "msg": "unable to cache server list", "component": "piaclient", "err": "disk full"},
+		{"level": "error", "v": 0.0, "msg": "ping failed", "component": "pinger", "region": "us_east", "host": "10.0.0.1", "err": "no replies received"},
+	}, lines)
+}
+
+func TestJsonKlog(t *testing.T) {
+	lines := logJson(t, 2, func() {
+		klog.V(2).Infof("connected to %s", "ca_toronto")
+		klog.V(3).Info("too verbose")
+		klog.Errorf("rotation failed: %v", "timeout")
+		klog.InfoS("structured", "region", "us_east")
+	})
+	require.Equal(t, []map[string]interface{}{
+		{"level": "info", "v": 2.0, "msg": "connected to ca_toronto"},
+		{"level": "error", "v": 0.0, "msg": "rotation failed: timeout"},
+		{"level": "info", "v": 0.0, "msg": "structured", "region": "us_east"},
+	}, lines)
+}
+
+func TestJsonRedacts(t *testing.T) {
+	AddSecret("jsonsecret")
+	lines := logJson(t, 0, func() {
+		log := Component("actions")
+		log.Info(`got {"token":"abc"} with jsonsecret`, "token", "xyz", "body", `{"private_key":"k"}`, "servers", []string{"jsonsecret"})
+		log.Error(errors.New(`Get "https://10.0.0.1/addKey?pt=abc": timeout`), "addKey failed")
+	})
+	require.Equal(t, []map[string]interface{}{
+		{"level": "info", "v": 0.0, "msg": `got {"token":"[REDACTED]"} with [REDACTED]`, "component": "actions",
+			"token": Redacted, "body": `{"private_key":"[REDACTED]"}`, "servers": []interface{}{Redacted}},
+		{"level": "error", "v": 0.0, "msg": "addKey failed", "component": "actions", "err": `Get "https://10.0.0.1/addKey?pt=[REDACTED]": timeout`},
+	}, lines)
+}
+
+func TestTextComponentFields(t *testing.T) {
+	var buf bytes.Buffer
+	Init(&buf, 4, FormatText)
+	defer Init(&bytes.Buffer{}, 0, FormatText)
+	log := Component("piaclient").WithRegion("ca_toronto")
+	log.V(4).Info("pia request", KeyDuration, 1500*time.Millisecond, "body", `{"a": 1}`)
+	log.Warning("slow")
+	klog.Flush()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], "I"))
+	require.Contains(t, lines[0], `json_test.go:`)
+	require.True(t, strings.HasSuffix(lines[0], `] pia request component=piaclient region=ca_toronto duration=1.5s body="{\"a\": 1}"`), lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "W"))
+	require.True(t, strings.HasSuffix(lines[1], `] slow component=piaclient region=ca_toronto`), lines[1])
+}
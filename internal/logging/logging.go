@@ -0,0 +1,75 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"flag"
+	"io"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// the log formats
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+var sink = struct {
+	sync.RWMutex
+	json *jsonLogger
+}{}
+
+// Init sends everything klog logs at or below verbosity through the redactor to out, as klog's
+// usual text or, with FormatJson, as json lines
+func Init(out io.Writer, verbosity int, format string) {
+	// klog's flags are set on a private flag set so the command line is left to kong
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	fs.Set("v", strconv.Itoa(verbosity))
+	// klog writes straight to stderr, bypassing the output set below, unless told it's logging to files
+	fs.Set("logtostderr", "false")
+	fs.Set("stderrthreshold", "FATAL")
+	// and it writes a message once per severity at or below the message's unless told not to
+	fs.Set("one_output", "true")
+	klog.SetOutput(NewWriter(out))
+	sink.Lock()
+	defer sink.Unlock()
+	sink.json = nil
+	if format == FormatJson {
+		// the json logger redacts each value; redacting the encoded line could break its escaping
+		l := NewJsonLogger(out).(jsonLogger)
+		sink.json = &l
+		klog.SetLogger(l)
+	} else {
+		klog.SetLogger(nil)
+	}
+}
+
+// currentJsonLogger returns a copy of the json logger when logging json, otherwise nil
+func currentJsonLogger() *jsonLogger {
+	sink.RLock()
+	defer sink.RUnlock()
+	if sink.json == nil {
+		return nil
+	}
+	l := *sink.json
+	return &l
+}
@@ -0,0 +1,102 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in the log
+const Redacted = "[REDACTED]"
+
+// secrets shorter than this are not tracked; replacing them everywhere would mangle the log
+const minSecretLen = 6
+
+// patterns match secrets by their shape, for ones that were never given to AddSecret
+var patterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// json fields, {"token":"...","private_key":"..."}, also when quoted inside another string
+	{regexp.MustCompile(`(?i)(\\?"(?:token|password|pwd|private_?key|signature)\\?"\s*:\s*)(\\?")[^"\\]*\\?"`), "${1}${2}" + Redacted + "${2}"},
+	// http auth headers, as dumped by resty
+	{regexp.MustCompile(`(?i)(authorization:\s*(?:basic|bearer)\s+)[^\s,"]+`), "${1}" + Redacted},
+	// query params, addKey?pt=...&pubkey=..., and structured log values, token="..."
+	{regexp.MustCompile(`(?i)((?:^|[?&\s])(?:pt|token|password|pwd|signature)=)("[^"]*"|[^&\s"]+)`), "${1}" + Redacted},
+	// wg configs: PrivateKey = ...
+	{regexp.MustCompile(`(?i)(private_?key\s*=\s*)\S+`), "${1}" + Redacted},
+	// command lines and env files: --pia-password xyz, PIA_PASSWORD="xyz"
+	{regexp.MustCompile(`(?i)(pia[-_]password[=\s]\s*)("[^"]*"|\S+)`), "${1}" + Redacted},
+}
+
+var known = struct {
+	sync.RWMutex
+	secrets []string
+}{}
+
+// AddSecret makes Redact replace every occurrence of s; passwords, auth tokens and private keys
+// should be added as soon as they're known
+func AddSecret(s string) {
+	if len(s) < minSecretLen {
+		return
+	}
+	known.Lock()
+	defer known.Unlock()
+	for _, k := range known.secrets {
+		if k == s {
+			return
+		}
+	}
+	known.secrets = append(known.secrets, s)
+	// longest first so a secret containing another is replaced whole
+	sort.Slice(known.secrets, func(i, j int) bool { return len(known.secrets[i]) > len(known.secrets[j]) })
+}
+
+// Redact returns s with the known secrets, and anything that looks like a secret, replaced
+func Redact(s string) string {
+	known.RLock()
+	for _, k := range known.secrets {
+		s = strings.ReplaceAll(s, k, Redacted)
+	}
+	known.RUnlock()
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewWriter returns a writer that redacts everything written to it before passing it on to w;
+// klog writes a whole log line per call so a secret is never split across writes
+func NewWriter(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
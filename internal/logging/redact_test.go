@@ -0,0 +1,70 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+)
+
+func TestRedactPatterns(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`{"status":"OK","token":"abc123"}`, `{"status":"OK","token":"[REDACTED]"}`},
+		{`{"Password": "pw", "private_key":"k="}`, `{"Password": "[REDACTED]", "private_key":"[REDACTED]"}`},
+		{"\t Authorization: Basic cDEyMzpzZWNyZXQ=\n", "\t Authorization: Basic [REDACTED]\n"},
+		{"GET /addKey?pt=abc%2Bdef&pubkey=xyz", "GET /addKey?pt=[REDACTED]&pubkey=xyz"},
+		{`Get "https://10.0.0.1:19999/getSignature?token=abc": dial tcp`, `Get "https://10.0.0.1:19999/getSignature?token=[REDACTED]": dial tcp`},
+		{"PrivateKey = aGVsbG8=\nAddress = 10.1.2.3/32", "PrivateKey = [REDACTED]\nAddress = 10.1.2.3/32"},
+		{"piawgcli daemon --pia-password s3cret --pia-id p1", "piawgcli daemon --pia-password [REDACTED] --pia-id p1"},
+		{`PIA_PASSWORD="s 3cret"`, `PIA_PASSWORD=[REDACTED]`},
+		{"region ca_toronto connected", "region ca_toronto connected"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, Redact(tt.in))
+	}
+}
+
+func TestRedactKnownSecrets(t *testing.T) {
+	AddSecret("abc")
+	AddSecret("tokentoken")
+	AddSecret("tokentokentoken")
+	require.Equal(t, "abc [REDACTED] [REDACTED]", Redact("abc tokentokentoken tokentoken"))
+}
+
+func TestInitRedactsKlog(t *testing.T) {
+	var buf bytes.Buffer
+	Init(&buf, 4, FormatText)
+	defer Init(&bytes.Buffer{}, 0, FormatText)
+	AddSecret("klogsecret")
+	klog.V(4).Infof("token is klogsecret")
+	klog.Errorf("failed with klogsecret")
+	klog.V(5).Infof("too verbose")
+	klog.Flush()
+	out := buf.String()
+	require.Contains(t, out, "token is [REDACTED]")
+	require.Contains(t, out, "failed with [REDACTED]")
+	require.NotContains(t, out, "klogsecret")
+	require.NotContains(t, out, "too verbose")
+	require.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")), "errors logged more than once")
+}
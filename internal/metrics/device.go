@@ -0,0 +1,74 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	handshakeAgeDesc = prometheus.NewDesc(namespace+"_handshake_age_seconds",
+		"Time since the last handshake with the interface's peer.", []string{"interface"}, nil)
+	receiveBytesDesc = prometheus.NewDesc(namespace+"_receive_bytes_total",
+		"Bytes received from the interface's peer.", []string{"interface"}, nil)
+	transmitBytesDesc = prometheus.NewDesc(namespace+"_transmit_bytes_total",
+		"Bytes sent to the interface's peer.", []string{"interface"}, nil)
+)
+
+// deviceCollector reads a wg device's peer stats at collection time so they're never stale
+type deviceCollector struct {
+	name string
+	read func(name string) (*wgtypes.Device, error)
+	now  func() time.Time
+}
+
+func newDeviceCollector(name string, read func(name string) (*wgtypes.Device, error)) *deviceCollector {
+	return &deviceCollector{
+		name: name,
+		read: read,
+		now:  time.Now,
+	}
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- handshakeAgeDesc
+	ch <- receiveBytesDesc
+	ch <- transmitBytesDesc
+}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	dev, err := c.read(c.name)
+	if err != nil {
+		log.V(4).Info("no metrics for device", "interface", c.name, logging.KeyError, err)
+		return
+	}
+	if len(dev.Peers) == 0 {
+		return
+	}
+	peer := dev.Peers[0]
+	// a device that has never completed a handshake has no age
+	if !peer.LastHandshakeTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(handshakeAgeDesc, prometheus.GaugeValue, c.now().Sub(peer.LastHandshakeTime).Seconds(), c.name)
+	}
+	ch <- prometheus.MustNewConstMetric(receiveBytesDesc, prometheus.CounterValue, float64(peer.ReceiveBytes), c.name)
+	ch <- prometheus.MustNewConstMetric(transmitBytesDesc, prometheus.CounterValue, float64(peer.TransmitBytes), c.name)
+}
@@ -0,0 +1,156 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const namespace = "piawgcli"
+
+var log = logging.Component("metrics")
+
+// Registry holds every piawgcli metric; metrics are always recorded but only served when Serve is called
+var Registry = prometheus.NewRegistry()
+
+var (
+	piaRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pia_request_duration_seconds",
+		Help:      "Latency of PIA api requests (generateToken, addKey) by region.",
+	}, []string{"request", "region"})
+	piaRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pia_request_errors_total",
+		Help:      "Failed PIA api requests (generateToken, addKey) by region.",
+	}, []string{"request", "region"})
+	reregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reregistrations_total",
+		Help:      "Tunnels registered with PIA to replace a dead, failed over or rotated session.",
+	}, []string{"interface", "region"})
+	currentRegion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "region",
+		Help:      "Region the interface is connected to; always 1.",
+	}, []string{"interface", "region"})
+	probeLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "region_probe_latency_seconds",
+		Help:      "Average latency of the last probe of the region.",
+	}, []string{"region"})
+	probeLoss = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "region_probe_loss_ratio",
+		Help:      "Fraction of samples lost by the last probe of the region.",
+	}, []string{"region"})
+	forwardedPort = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "forwarded_port",
+		Help:      "Port currently forwarded by PIA.",
+	})
+	forwardedPortExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "forwarded_port_expiry_timestamp_seconds",
+		Help:      "When the forwarded port expires, in seconds since the epoch.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		piaRequestDuration,
+		piaRequestErrors,
+		reregistrations,
+		currentRegion,
+		probeLatency,
+		probeLoss,
+		forwardedPort,
+		forwardedPortExpiry,
+	)
+}
+
+// ObservePiaRequest records the latency, and any error, of a PIA api request
+func ObservePiaRequest(request string, region string, took time.Duration, err error) {
+	piaRequestDuration.WithLabelValues(request, region).Observe(took.Seconds())
+	if err != nil {
+		piaRequestErrors.WithLabelValues(request, region).Inc()
+	}
+}
+
+func Reregistered(iface string, region string) {
+	reregistrations.WithLabelValues(iface, region).Inc()
+}
+
+func SetRegion(iface string, region string) {
+	currentRegion.Reset()
+	currentRegion.WithLabelValues(iface, region).Set(1)
+}
+
+// ObserveProbe records the result of probing a region with a Pinger
+func ObserveProbe(region string, result os.PingResult) {
+	probeLoss.WithLabelValues(region).Set(result.Loss())
+	if result.Reachable() {
+		probeLatency.WithLabelValues(region).Set(result.Avg.Seconds())
+	} else {
+		probeLatency.DeleteLabelValues(region)
+	}
+}
+
+func SetForwardedPort(port uint16, expiresAt time.Time) {
+	forwardedPort.Set(float64(port))
+	forwardedPortExpiry.Set(float64(expiresAt.Unix()))
+}
+
+// WatchDevice exports the handshake age and transfer totals of the named wg device, read
+// through read whenever metrics are collected
+func WatchDevice(name string, read func(name string) (*wgtypes.Device, error)) {
+	Registry.MustRegister(newDeviceCollector(name, read))
+}
+
+// Serve serves the metrics at /metrics on addr until ctx is cancelled
+func Serve(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.V(1).Info("serving metrics", "addr", l.Addr())
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error(err, "metrics server failed")
+		}
+	}()
+	return nil
+}
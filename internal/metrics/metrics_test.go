@@ -0,0 +1,109 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestObservePiaRequest(t *testing.T) {
+	ObservePiaRequest("addKey", "ca_toronto", 100*time.Millisecond, nil)
+	ObservePiaRequest("addKey", "ca_toronto", 200*time.Millisecond, errors.New("timeout"))
+	require.Equal(t, float64(1), testutil.ToFloat64(piaRequestErrors.WithLabelValues("addKey", "ca_toronto")))
+	require.Equal(t, 1, testutil.CollectAndCount(piaRequestDuration))
+}
+
+func TestSetRegionReplacesPrevious(t *testing.T) {
+	SetRegion("pia", "ca_toronto")
+	SetRegion("pia", "ca_montreal")
+	require.Equal(t, 1, testutil.CollectAndCount(currentRegion))
+	require.Equal(t, float64(1), testutil.ToFloat64(currentRegion.WithLabelValues("pia", "ca_montreal")))
+}
+
+func TestObserveProbe(t *testing.T) {
+	ObserveProbe("ca_toronto", os.PingResult{Sent: 4, Received: 3, Avg: 20 * time.Millisecond})
+	require.Equal(t, 0.02, testutil.ToFloat64(probeLatency.WithLabelValues("ca_toronto")))
+	require.Equal(t, 0.25, testutil.ToFloat64(probeLoss.WithLabelValues("ca_toronto")))
+	// latency is dropped, rather than left stale, once the region stops answering
+	ObserveProbe("ca_toronto", os.PingResult{Sent: 4})
+	require.Equal(t, 0, testutil.CollectAndCount(probeLatency))
+	require.Equal(t, float64(1), testutil.ToFloat64(probeLoss.WithLabelValues("ca_toronto")))
+}
+
+func TestDeviceCollector(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newDeviceCollector("pia", func(name string) (*wgtypes.Device, error) {
+		return &wgtypes.Device{Name: name, Peers: []wgtypes.Peer{{
+			LastHandshakeTime: now.Add(-90 * time.Second),
+			ReceiveBytes:      1024,
+			TransmitBytes:     2048,
+		}}}, nil
+	})
+	c.now = func() time.Time { return now }
+	expected := `
+# HELP piawgcli_handshake_age_seconds Time since the last handshake with the interface's peer.
+# TYPE piawgcli_handshake_age_seconds gauge
+piawgcli_handshake_age_seconds{interface="pia"} 90
+# HELP piawgcli_receive_bytes_total Bytes received from the interface's peer.
+# TYPE piawgcli_receive_bytes_total counter
+piawgcli_receive_bytes_total{interface="pia"} 1024
+# HELP piawgcli_transmit_bytes_total Bytes sent to the interface's peer.
+# TYPE piawgcli_transmit_bytes_total counter
+piawgcli_transmit_bytes_total{interface="pia"} 2048
+`
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+}
+
+func TestDeviceCollectorMissingDevice(t *testing.T) {
+	c := newDeviceCollector("pia", func(name string) (*wgtypes.Device, error) {
+		return nil, errors.New("no such device")
+	})
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, Serve(ctx, addr))
+	SetForwardedPort(47047, time.Unix(1700000000, 0))
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "piawgcli_forwarded_port 47047")
+	require.Contains(t, string(body), "piawgcli_forwarded_port_expiry_timestamp_seconds 1.7e+09")
+
+	require.Error(t, Serve(ctx, addr), "address is in use")
+}
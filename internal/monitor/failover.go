@@ -0,0 +1,109 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package monitor
+
+import (
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+// Policy picks the region to connect to from an ordered list of preferred regions; a region
+// that fails too many times in a row is avoided for a cooldown, after which it's preferred again
+type Policy struct {
+	regions   []string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	state     map[string]*regionState
+}
+
+type regionState struct {
+	failures  int       // consecutive failures
+	downUntil time.Time // avoided until then
+}
+
+// NewPolicy returns a policy that fails over after threshold consecutive failures and fails
+// back after cooldown; regions are in order of preference
+func NewPolicy(regions []string, threshold int, cooldown time.Duration) *Policy {
+	p := &Policy{
+		regions:   regions,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     map[string]*regionState{},
+	}
+	for _, r := range regions {
+		p.state[r] = &regionState{}
+	}
+	return p
+}
+
+// Region returns the most preferred region that isn't cooling down; when they all are, the
+// one that's due back first is used
+func (p *Policy) Region() string {
+	now := p.now()
+	next := p.regions[0]
+	for _, r := range p.regions {
+		if !now.Before(p.state[r].downUntil) {
+			return r
+		}
+		if p.state[r].downUntil.Before(p.state[next].downUntil) {
+			next = r
+		}
+	}
+	return next
+}
+
+// Failed records a failure (token, addKey or handshake) of the given region
+func (p *Policy) Failed(region string) {
+	s, ok := p.state[region]
+	if !ok {
+		return
+	}
+	s.failures++
+	log.V(4).Info("region failed", logging.KeyRegion, region, "failures", s.failures, "threshold", p.threshold)
+	if s.failures >= p.threshold {
+		s.failures = 0
+		s.downUntil = p.now().Add(p.cooldown)
+		log.Warning("region failed too many times in a row, avoiding it", logging.KeyRegion, region, "failures", p.threshold, "until", s.downUntil.Format(time.RFC3339))
+	}
+}
+
+// Succeeded records that the given region is working
+func (p *Policy) Succeeded(region string) {
+	if s, ok := p.state[region]; ok {
+		s.failures = 0
+		s.downUntil = time.Time{}
+	}
+}
+
+// Prefer makes the given region the most preferred one, adding it when it's not already listed
+func (p *Policy) Prefer(region string) {
+	regions := []string{region}
+	for _, r := range p.regions {
+		if r != region {
+			regions = append(regions, r)
+		}
+	}
+	p.regions = regions
+	if _, ok := p.state[region]; !ok {
+		p.state[region] = &regionState{}
+	}
+	p.Succeeded(region)
+}
@@ -0,0 +1,148 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyFailsOverAndBack(t *testing.T) {
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPolicy([]string{"a", "b", "c"}, 2, time.Hour)
+	p.now = func() time.Time { return clock }
+	require.Equal(t, "a", p.Region())
+	p.Failed("a")
+	require.Equal(t, "a", p.Region())
+	p.Failed("a")
+	require.Equal(t, "b", p.Region())
+
+	// a success resets the count of consecutive failures
+	p.Failed("b")
+	p.Succeeded("b")
+	p.Failed("b")
+	require.Equal(t, "b", p.Region())
+
+	clock = clock.Add(time.Hour)
+	require.Equal(t, "a", p.Region())
+}
+
+func TestPolicyAllRegionsDown(t *testing.T) {
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPolicy([]string{"a", "b"}, 1, time.Hour)
+	p.now = func() time.Time { return clock }
+	p.Failed("a")
+	clock = clock.Add(time.Minute)
+	p.Failed("b")
+	// a is due back first
+	require.Equal(t, "a", p.Region())
+	clock = clock.Add(time.Minute)
+	p.Failed("a")
+	require.Equal(t, "b", p.Region())
+}
+
+func TestPolicyIgnoresUnknownRegions(t *testing.T) {
+	p := NewPolicy([]string{"a"}, 1, time.Hour)
+	p.Failed("z")
+	p.Succeeded("z")
+	require.Equal(t, "a", p.Region())
+}
+
+func TestPolicyPrefer(t *testing.T) {
+	p := NewPolicy([]string{"a", "b"}, 1, time.Hour)
+	p.Failed("b")
+	p.Prefer("b")
+	require.Equal(t, "b", p.Region())
+	p.Prefer("z")
+	require.Equal(t, "z", p.Region())
+	require.Equal(t, []string{"z", "b", "a"}, p.regions)
+}
+
+func newFailoverFixture() *fixture {
+	f := newFixture()
+	f.mon.cfg.Regions = []string{"ca_toronto", "ca_montreal"}
+	f.mon.cfg.FailoverAfter = 2
+	f.mon.cfg.MinBackoff = time.Second
+	f.mon.cfg.MaxBackoff = time.Second
+	f.mon.policy = NewPolicy(f.mon.cfg.Regions, 2, time.Hour)
+	f.mon.policy.now = func() time.Time { return f.clock }
+	return f
+}
+
+// retry moves past any backoff and runs the next check
+func (f *fixture) retry() {
+	f.clock = f.clock.Add(time.Minute)
+	f.mon.tick(context.Background())
+}
+
+func TestMonitorFailsOverWhenAddKeyKeepsFailing(t *testing.T) {
+	f := newFailoverFixture()
+	f.pia.down["ca_toronto"] = true
+	f.mon.tick(context.Background())
+	f.retry()
+	f.retry()
+	require.Equal(t, []string{"ca_toronto", "ca_toronto", "ca_montreal"}, f.pia.regions)
+	require.Equal(t, "ca_montreal", f.mon.region)
+	require.Zero(t, f.mon.failures)
+}
+
+func TestMonitorFailsOverWhenHandshakesKeepFailing(t *testing.T) {
+	f := newFailoverFixture()
+	f.mon.tick(context.Background())
+	require.Equal(t, "ca_toronto", f.mon.region)
+	// addKey works but the sessions never handshake
+	f.retry()
+	f.retry()
+	require.Equal(t, []string{"ca_toronto", "ca_toronto", "ca_montreal"}, f.pia.regions)
+	require.Equal(t, "ca_montreal", f.mon.region)
+}
+
+func TestMonitorCountsOneFailurePerTick(t *testing.T) {
+	f := newFailoverFixture()
+	f.mon.tick(context.Background())
+	// the session dies and re-registering with the region fails in the same tick
+	f.pia.down["ca_toronto"] = true
+	f.retry()
+	f.retry()
+	require.Equal(t, []string{"ca_toronto", "ca_toronto", "ca_toronto"}, f.pia.regions)
+	f.retry()
+	require.Equal(t, "ca_montreal", f.mon.region)
+}
+
+func TestMonitorFailsBackAfterCooldown(t *testing.T) {
+	f := newFailoverFixture()
+	f.pia.down["ca_toronto"] = true
+	f.mon.tick(context.Background())
+	f.retry()
+	f.retry()
+	require.Equal(t, "ca_montreal", f.mon.region)
+	f.pia.down["ca_toronto"] = false
+
+	// healthy sessions stay put until the cooldown has passed
+	f.wg.peer().LastHandshakeTime = f.clock
+	f.mon.tick(context.Background())
+	require.Equal(t, "ca_montreal", f.mon.region)
+
+	f.clock = f.clock.Add(time.Hour)
+	f.wg.peer().LastHandshakeTime = f.clock
+	f.mon.tick(context.Background())
+	require.Equal(t, "ca_toronto", f.mon.region)
+}
@@ -0,0 +1,354 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/metrics"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var log = logging.Component("monitor")
+
+// Device is the part of wgdevice.Manager used to watch and re-apply the tunnel
+type Device interface {
+	Device(name string) (*wgtypes.Device, error)
+	Up(name string, iface piaclient.PiaInterface, opts wgdevice.Options) error
+}
+
+// Config controls what is monitored and how a dead session is handled
+type Config struct {
+	Interface        string
+	PiaId            string
+	PiaPassword      string
+	Regions          []string // in order of preference
+	FailoverAfter    int      // consecutive failures of a region before failing over to the next one
+	FailbackAfter    time.Duration
+	Device           wgdevice.Options
+	Interval         time.Duration // how often the session is checked
+	HandshakeTimeout time.Duration // a session whose last handshake is older than this is stale
+	PingSamples      uint8
+	MinBackoff       time.Duration // wait after the first failed re-registration; doubled on each failure after that
+	MaxBackoff       time.Duration
+	OnConnect        func(iface piaclient.PiaInterface) // optional; called whenever a new tunnel is applied
+}
+
+// Status is a snapshot of the monitored session
+type Status struct {
+	Interface       string
+	Connected       bool
+	Region          string    `json:",omitempty"`
+	ServerEndpoint  string    `json:",omitempty"`
+	ServerVirtualIp string    `json:",omitempty"`
+	ClientIp        string    `json:",omitempty"`
+	ClientPublicKey string    `json:",omitempty"`
+	LastHandshake   time.Time `json:",omitempty"`
+	ReceiveBytes    int64
+	TransmitBytes   int64
+	Failures        int // consecutive failed re-registrations
+}
+
+// Monitor keeps a PIA tunnel on a wg device alive; when the session dies a new tunnel is
+// registered with PIA and applied to the device
+type Monitor struct {
+	cfg    Config
+	pia    piaclient.PiaClient
+	dev    Device
+	pinger os.Pinger
+	policy *Policy
+	now    func() time.Time
+
+	lock      sync.Mutex // guards the session state below, which Apply changes from outside Run
+	region    string     // region of the current tunnel
+	iface     piaclient.PiaInterface
+	connected bool
+	rxBytes   int64
+	failures  int
+	retryAt   time.Time
+
+	// status is a snapshot of the session for Status; it has its own lock, held only briefly, so Status
+	// answers while a check, which may take as long as a ping and a re-registration, holds lock
+	statusLock sync.Mutex
+	status     Status
+	lastTick   time.Time // when a check last started or finished, guarded by statusLock
+
+	ready     chan struct{} // closed once the first tunnel is applied
+	readyOnce sync.Once
+}
+
+func New(cfg Config, pia piaclient.PiaClient, dev Device, pinger os.Pinger) *Monitor {
+	m := &Monitor{
+		cfg:    cfg,
+		pia:    pia,
+		dev:    dev,
+		pinger: pinger,
+		policy: NewPolicy(cfg.Regions, cfg.FailoverAfter, cfg.FailbackAfter),
+		now:    time.Now,
+		status: Status{Interface: cfg.Interface},
+		ready:  make(chan struct{}),
+	}
+	m.policy.now = func() time.Time { return m.now() }
+	return m
+}
+
+// Run establishes the tunnel and then checks it every interval until ctx is cancelled
+func (m *Monitor) Run(ctx context.Context) error {
+	m.tick(ctx)
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.V(1).Info("monitor stopped")
+			return nil
+		case <-ticker.C:
+			m.tick(ctx)
+		}
+	}
+}
+
+// tick checks the session, re-registering it when it's dead and any backoff has passed
+func (m *Monitor) tick(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ticked()
+	defer m.ticked()
+	if m.failures > 0 && m.now().Before(m.retryAt) {
+		log.V(4).Info("waiting to retry", "retryAt", m.retryAt.Format(time.RFC3339))
+		return
+	}
+	// one failure is counted per tick, whether the session died, re-registering failed or both
+	counted := ""
+	if m.connected && m.failures == 0 {
+		if !m.healthy(ctx) {
+			m.policy.Failed(m.region)
+			counted = m.region
+		} else {
+			m.policy.Succeeded(m.region)
+			preferred := m.policy.Region()
+			if preferred == m.region {
+				return
+			}
+			log.Info("failing back", logging.KeyRegion, preferred)
+		}
+	}
+	region := m.policy.Region()
+	if err := m.connectTo(region); err != nil {
+		if region != counted {
+			m.policy.Failed(region)
+		}
+		m.failures++
+		m.retryAt = m.now().Add(m.backoff())
+		m.publish()
+		log.Error(err, "re-registration failed", logging.KeyRegion, region, "attempt", m.failures, "retryAt", m.retryAt.Format(time.RFC3339))
+	}
+}
+
+// Reconnect registers a new tunnel, with a new key, right away
+func (m *Monitor) Reconnect() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.connect()
+}
+
+// SwitchRegion connects to the given region and makes it the preferred region
+func (m *Monitor) SwitchRegion(region string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.connectTo(region); err != nil {
+		m.policy.Failed(region)
+		return err
+	}
+	m.policy.Prefer(region)
+	return nil
+}
+
+// Status returns the current state of the session without waiting for a check in progress
+func (m *Monitor) Status() Status {
+	m.statusLock.Lock()
+	status := m.status
+	m.statusLock.Unlock()
+	if !status.Connected {
+		return status
+	}
+	if dev, err := m.dev.Device(m.cfg.Interface); err == nil && len(dev.Peers) > 0 {
+		status.LastHandshake = dev.Peers[0].LastHandshakeTime
+		status.ReceiveBytes = dev.Peers[0].ReceiveBytes
+		status.TransmitBytes = dev.Peers[0].TransmitBytes
+	}
+	return status
+}
+
+// Ready returns a channel that's closed once the first tunnel is up
+func (m *Monitor) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// LastTick returns when a check last started or finished; it falls behind when a check is stuck
+func (m *Monitor) LastTick() time.Time {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return m.lastTick
+}
+
+func (m *Monitor) ticked() {
+	now := m.now()
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.lastTick = now
+}
+
+// publish updates the snapshot returned by Status; it's called, with lock held, whenever the session changes
+func (m *Monitor) publish() {
+	status := Status{
+		Interface: m.cfg.Interface,
+		Connected: m.connected,
+		Failures:  m.failures,
+	}
+	if m.connected {
+		status.Region = m.region
+		status.ServerEndpoint = fmt.Sprintf("%s:%d", m.iface.ServerEndpoint, m.iface.ServerPort)
+		status.ServerVirtualIp = m.iface.ServerVirtualIp
+		status.ClientIp = m.iface.ClientIp
+		status.ClientPublicKey = m.iface.ClientPublicKey
+	}
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.status = status
+}
+
+// Region returns the region the failover policy currently prefers
+func (m *Monitor) Region() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.policy.Region()
+}
+
+func (m *Monitor) backoff() time.Duration {
+	wait := m.cfg.MinBackoff
+	for i := 1; i < m.failures && wait < m.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > m.cfg.MaxBackoff {
+		wait = m.cfg.MaxBackoff
+	}
+	return wait
+}
+
+// healthy reports whether the session is still alive: a recent handshake, or traffic
+// received since the last check, or the server's virtual ip answering through the tunnel
+func (m *Monitor) healthy(ctx context.Context) bool {
+	dev, err := m.dev.Device(m.cfg.Interface)
+	if err != nil {
+		log.Warning("session dead", "interface", m.cfg.Interface, logging.KeyError, err)
+		return false
+	}
+	if len(dev.Peers) == 0 {
+		log.Warning("session dead: no peer", "interface", m.cfg.Interface)
+		return false
+	}
+	peer := dev.Peers[0]
+	received := peer.ReceiveBytes > m.rxBytes
+	m.rxBytes = peer.ReceiveBytes
+	age := m.now().Sub(peer.LastHandshakeTime)
+	log.V(4).Info("last handshake", logging.KeyRegion, m.region, "age", age.Round(time.Second), "rx", peer.ReceiveBytes, "tx", peer.TransmitBytes)
+	if !peer.LastHandshakeTime.IsZero() && age < m.cfg.HandshakeTimeout {
+		return true
+	}
+	if received {
+		return true
+	}
+	result := m.pinger.Ping(ctx, m.iface.ServerVirtualIp, m.cfg.PingSamples)
+	metrics.ObserveProbe(m.region, result)
+	if result.Reachable() {
+		log.V(1).Info("handshake is stale but the server is reachable", logging.KeyRegion, m.region, "addr", m.iface.ServerVirtualIp)
+		return true
+	}
+	last := "never"
+	if !peer.LastHandshakeTime.IsZero() {
+		last = age.Round(time.Second).String() + " ago"
+	}
+	log.Warning("session dead: stale handshake and the server is unreachable", logging.KeyRegion, m.region, "lastHandshake", last, "addr", m.iface.ServerVirtualIp, logging.KeyError, result.Err)
+	return false
+}
+
+// connect registers a new tunnel with the region picked by the failover policy and applies
+// it to the device
+func (m *Monitor) connect() error {
+	region := m.policy.Region()
+	err := m.connectTo(region)
+	if err != nil {
+		m.policy.Failed(region)
+	}
+	return err
+}
+
+// connectTo registers a new tunnel with the given region and applies it to the device; the caller
+// records any failure with the failover policy
+func (m *Monitor) connectTo(region string) error {
+	log.V(1).Info("registering a new tunnel", logging.KeyRegion, region)
+	iface, err := m.pia.CreateTunnel(m.cfg.PiaId, m.cfg.PiaPassword, region)
+	if err != nil {
+		return err
+	}
+	return m.apply(iface)
+}
+
+// Apply swaps the device onto the given tunnel, which was registered elsewhere (i.e. by a key rotation),
+// and makes its region the preferred region so the next check doesn't fail back from it
+func (m *Monitor) Apply(iface piaclient.PiaInterface) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.apply(iface); err != nil {
+		return err
+	}
+	m.policy.Prefer(iface.PiaRegion.Id)
+	return nil
+}
+
+func (m *Monitor) apply(iface piaclient.PiaInterface) error {
+	if err := m.dev.Up(m.cfg.Interface, iface, m.cfg.Device); err != nil {
+		return err
+	}
+	if m.connected {
+		metrics.Reregistered(m.cfg.Interface, iface.PiaRegion.Id)
+	}
+	metrics.SetRegion(m.cfg.Interface, iface.PiaRegion.Id)
+	m.region = iface.PiaRegion.Id
+	m.iface = iface
+	m.connected = true
+	m.rxBytes = 0
+	// a working tunnel, however it was brought up, ends any backoff
+	m.failures = 0
+	m.retryAt = time.Time{}
+	m.publish()
+	m.readyOnce.Do(func() { close(m.ready) })
+	if m.cfg.OnConnect != nil {
+		m.cfg.OnConnect(iface)
+	}
+	log.Info("connected", "interface", m.cfg.Interface, logging.KeyRegion, iface.PiaRegion.Id, "endpoint", fmt.Sprintf("%s:%d", iface.ServerEndpoint, iface.ServerPort))
+	return nil
+}
@@ -0,0 +1,333 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	stdos "os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/wgdevice"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWg is an in memory wgctrl client; tests move the peer's handshake and counters directly
+type fakeWg struct {
+	devices map[string]*wgtypes.Device
+}
+
+func (f *fakeWg) Devices() ([]*wgtypes.Device, error) {
+	return nil, nil
+}
+
+func (f *fakeWg) Device(name string) (*wgtypes.Device, error) {
+	d, ok := f.devices[name]
+	if !ok {
+		return nil, stdos.ErrNotExist
+	}
+	return d, nil
+}
+
+func (f *fakeWg) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	d := &wgtypes.Device{Name: name, PrivateKey: *cfg.PrivateKey}
+	for _, p := range cfg.Peers {
+		d.Peers = append(d.Peers, wgtypes.Peer{PublicKey: p.PublicKey, Endpoint: p.Endpoint})
+	}
+	f.devices[name] = d
+	return nil
+}
+
+func (f *fakeWg) Close() error {
+	return nil
+}
+
+func (f *fakeWg) peer() *wgtypes.Peer {
+	return &f.devices["pia"].Peers[0]
+}
+
+type nopLink struct{}
+
+func (nopLink) Create(string) error                            { return nil }
+func (nopLink) Delete(string) error                            { return nil }
+func (nopLink) Address(string) (*net.IPNet, error)             { return nil, nil }
+func (nopLink) SetAddress(string, *net.IPNet) error            { return nil }
+func (nopLink) Up(string) error                                { return nil }
+func (nopLink) AddRoutes(string, net.IP, []net.IPNet) error    { return nil }
+func (nopLink) DeleteRoutes(string, net.IP) error              { return nil }
+func (nopLink) MoveEndpointRoute(string, net.IP, net.IP) error { return nil }
+func (nopLink) SetDns(string, []string) error                  { return nil }
+func (nopLink) RestoreDns(string) error                        { return nil }
+func (nopLink) KillSwitch(string) bool                         { return false }
+func (nopLink) SetKillSwitch(string, net.IP) error             { return nil }
+func (nopLink) DeleteKillSwitch(string) error                  { return nil }
+
+// fakePia registers tunnels, failing the first fails calls and any call for a region that's down
+type fakePia struct {
+	piaclient.PiaClient
+	tunnels int
+	fails   int
+	down    map[string]bool
+	regions []string // region of each call
+}
+
+func (f *fakePia) CreateTunnel(id string, pwd string, regionId string) (piaclient.PiaInterface, error) {
+	f.regions = append(f.regions, regionId)
+	if f.fails > 0 || f.down[regionId] {
+		if f.fails > 0 {
+			f.fails--
+		}
+		return piaclient.PiaInterface{}, errors.New("addKey failed")
+	}
+	f.tunnels++
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	return piaclient.PiaInterface{
+		ServerPublicKey:  serverKey.PublicKey().String(),
+		ServerPort:       1337,
+		ServerEndpoint:   fmt.Sprintf("192.0.2.%d", f.tunnels),
+		ServerVirtualIp:  "10.0.0.1",
+		ClientIp:         "10.1.2.3",
+		ClientPrivateKey: clientKey.String(),
+		PiaRegion:        piaclient.PiaRegion{Id: regionId},
+	}, nil
+}
+
+type fakePinger struct {
+	reachable bool
+	pings     int
+}
+
+func (p *fakePinger) Ping(context.Context, string, uint8) os.PingResult {
+	p.pings++
+	if p.reachable {
+		return os.PingResult{Sent: 1, Received: 1}
+	}
+	return os.PingResult{Sent: 1, Err: errors.New("timeout")}
+}
+
+type fixture struct {
+	wg     *fakeWg
+	pia    *fakePia
+	pinger *fakePinger
+	mon    *Monitor
+	clock  time.Time
+}
+
+func newFixture() *fixture {
+	f := &fixture{
+		wg:     &fakeWg{devices: map[string]*wgtypes.Device{}},
+		pia:    &fakePia{down: map[string]bool{}},
+		pinger: &fakePinger{},
+		clock:  time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cfg := Config{
+		Interface:        "pia",
+		Regions:          []string{"ca_toronto"},
+		FailoverAfter:    3,
+		FailbackAfter:    time.Hour,
+		Interval:         time.Minute,
+		HandshakeTimeout: 3 * time.Minute,
+		PingSamples:      1,
+		MinBackoff:       10 * time.Second,
+		MaxBackoff:       time.Minute,
+	}
+	f.mon = New(cfg, f.pia, wgdevice.NewWithClients(f.wg, nopLink{}), f.pinger)
+	f.mon.now = func() time.Time { return f.clock }
+	return f
+}
+
+func TestMonitorConnectsOnStart(t *testing.T) {
+	f := newFixture()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, f.mon.Run(ctx))
+	require.Equal(t, 1, f.pia.tunnels)
+	require.Equal(t, "192.0.2.1:1337", f.wg.peer().Endpoint.String())
+}
+
+func TestMonitorReadyOnceConnected(t *testing.T) {
+	f := newFixture()
+	f.pia.fails = 1
+	f.mon.tick(context.Background())
+	require.Equal(t, f.clock, f.mon.LastTick())
+	select {
+	case <-f.mon.Ready():
+		t.Fatal("ready before a tunnel was applied")
+	default:
+	}
+
+	f.clock = f.mon.retryAt
+	f.mon.tick(context.Background())
+	require.Equal(t, f.clock, f.mon.LastTick())
+	select {
+	case <-f.mon.Ready():
+	default:
+		t.Fatal("not ready after a tunnel was applied")
+	}
+	// later tunnels don't close it again
+	require.NoError(t, f.mon.Reconnect())
+}
+
+func TestMonitorRecentHandshakeIsHealthy(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	f.wg.peer().LastHandshakeTime = f.clock.Add(-time.Minute)
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.pia.tunnels)
+	require.Zero(t, f.pinger.pings)
+}
+
+func TestMonitorStaleHandshakeButReachable(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	f.wg.peer().LastHandshakeTime = f.clock.Add(-10 * time.Minute)
+	f.pinger.reachable = true
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.pia.tunnels)
+	require.Equal(t, 1, f.pinger.pings)
+}
+
+func TestMonitorStaleHandshakeButReceiving(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	f.wg.peer().ReceiveBytes = 1024
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.pia.tunnels)
+	require.Zero(t, f.pinger.pings)
+}
+
+func TestMonitorReconnectsDeadSession(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	f.wg.peer().LastHandshakeTime = f.clock.Add(-10 * time.Minute)
+	f.mon.tick(context.Background())
+	require.Equal(t, 2, f.pia.tunnels)
+	require.Equal(t, "192.0.2.2:1337", f.wg.peer().Endpoint.String())
+}
+
+func TestMonitorBacksOff(t *testing.T) {
+	f := newFixture()
+	f.pia.fails = 4
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.mon.failures)
+	require.Equal(t, f.clock.Add(10*time.Second), f.mon.retryAt)
+
+	// no attempt is made until the backoff has passed
+	f.mon.tick(context.Background())
+	require.Equal(t, 3, f.pia.fails)
+
+	var waits []time.Duration
+	for f.pia.fails > 0 {
+		f.clock = f.mon.retryAt
+		f.mon.tick(context.Background())
+		waits = append(waits, f.mon.retryAt.Sub(f.clock))
+	}
+	require.Equal(t, []time.Duration{20 * time.Second, 40 * time.Second, time.Minute}, waits)
+
+	f.clock = f.mon.retryAt
+	f.mon.tick(context.Background())
+	require.Zero(t, f.mon.failures)
+	require.Equal(t, 1, f.pia.tunnels)
+}
+
+func TestMonitorReconnectEndsBackoff(t *testing.T) {
+	f := newFixture()
+	f.pia.fails = 1
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.mon.Status().Failures)
+
+	require.NoError(t, f.mon.Reconnect())
+	require.Zero(t, f.mon.Status().Failures)
+
+	// the tunnel brought up by hand is checked, and kept, rather than replaced when the backoff ends
+	f.clock = f.clock.Add(10 * time.Second)
+	f.wg.peer().LastHandshakeTime = f.clock
+	f.mon.tick(context.Background())
+	require.Equal(t, 1, f.pia.tunnels)
+}
+
+func TestMonitorApply(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	iface, err := f.pia.CreateTunnel("", "", "ca_montreal")
+	require.NoError(t, err)
+	require.NoError(t, f.mon.Apply(iface))
+	require.Equal(t, "ca_montreal", f.mon.region)
+	require.Equal(t, "192.0.2.2:1337", f.wg.peer().Endpoint.String())
+	require.Equal(t, "ca_montreal", f.mon.Region())
+
+	// the next healthy check keeps the rotated region rather than failing back
+	f.wg.peer().LastHandshakeTime = f.clock
+	f.clock = f.clock.Add(time.Minute)
+	f.mon.tick(context.Background())
+	require.Equal(t, "ca_montreal", f.mon.region)
+	require.Equal(t, 2, f.pia.tunnels)
+}
+
+func TestMonitorSwitchRegion(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	require.NoError(t, f.mon.SwitchRegion("ca_montreal"))
+	require.Equal(t, "ca_montreal", f.mon.Region())
+	require.Equal(t, "192.0.2.2:1337", f.wg.peer().Endpoint.String())
+
+	// a region that can't be registered with leaves the tunnel alone
+	f.pia.down["us_texas"] = true
+	require.Error(t, f.mon.SwitchRegion("us_texas"))
+	require.Equal(t, "ca_montreal", f.mon.Region())
+	require.Equal(t, "192.0.2.2:1337", f.wg.peer().Endpoint.String())
+}
+
+func TestMonitorStatus(t *testing.T) {
+	f := newFixture()
+	require.Equal(t, Status{Interface: "pia"}, f.mon.Status())
+	f.mon.tick(context.Background())
+	f.wg.peer().LastHandshakeTime = f.clock
+	f.wg.peer().ReceiveBytes = 100
+	status := f.mon.Status()
+	require.True(t, status.Connected)
+	require.Equal(t, "ca_toronto", status.Region)
+	require.Equal(t, "192.0.2.1:1337", status.ServerEndpoint)
+	require.Equal(t, f.clock, status.LastHandshake)
+	require.EqualValues(t, 100, status.ReceiveBytes)
+}
+
+func TestMonitorStatusDoesNotWaitForCheck(t *testing.T) {
+	f := newFixture()
+	f.mon.tick(context.Background())
+	// as if a check were stuck pinging or re-registering
+	f.mon.lock.Lock()
+	defer f.mon.lock.Unlock()
+	done := make(chan Status)
+	go func() {
+		done <- f.mon.Status()
+	}()
+	select {
+	case status := <-done:
+		require.Equal(t, "ca_toronto", status.Region)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status waited for the check")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+const serverListCacheFile = "serverlist.json"
+
+// cachedServerList is the on disk copy of the last server list downloaded
+type cachedServerList struct {
+	Url          string
+	FetchedOn    time.Time
+	ETag         string
+	LastModified string
+	List         string
+	Signature    string
+}
+
+type serverListCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// DefaultCacheDir returns the directory the server list is cached in when no other directory is given
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "piawgcli")
+}
+
+func (c serverListCache) enabled() bool {
+	return len(c.dir) > 0
+}
+
+func (c serverListCache) path() string {
+	return filepath.Join(c.dir, serverListCacheFile)
+}
+
+// load returns the cached copy of the server list downloaded from url; nil when there is none
+func (c serverListCache) load(url string) *cachedServerList {
+	if !c.enabled() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("unable to read server list cache", logging.KeyError, err)
+		}
+		return nil
+	}
+	entry := cachedServerList{}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		log.Warning("ignoring corrupt server list cache", logging.KeyError, err)
+		return nil
+	}
+	if entry.Url != url {
+		log.V(4).Info("ignoring server list cache of another url", "cachedUrl", entry.Url, "url", url)
+		return nil
+	}
+	return &entry
+}
+
+func (c serverListCache) fresh(entry *cachedServerList) bool {
+	return entry != nil && time.Since(entry.FetchedOn) < c.ttl
+}
+
+func (c serverListCache) save(entry *cachedServerList) error {
+	if !c.enabled() {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("unable to create cache dir: %w", err)
+	}
+	tmp, err := ioutil.TempFile(c.dir, serverListCacheFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path())
+}
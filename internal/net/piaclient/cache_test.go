@@ -0,0 +1,184 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testServerList = `{"groups":{},"regions":[{"id":"ca_toronto","name":"CA Toronto","dns":"ca-toronto.privacy.network",` +
+	`"servers":{"meta":[{"ip":"127.0.0.1","cn":"toronto401"}],"wg":[{"ip":"127.0.0.1","cn":"toronto401"}]}}]}` +
+	"\n\nc2lnbmF0dXJl\n"
+
+type serverListServer struct {
+	*httptest.Server
+	hits        int32
+	conditional int32
+}
+
+func newServerListServer() *serverListServer {
+	s := &serverListServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.hits, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&s.conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testServerList))
+	}))
+	return s
+}
+
+func TestServerListIsCached(t *testing.T) {
+	srv := newServerListServer()
+	defer srv.Close()
+	opts := Options{CacheDir: t.TempDir(), CacheTtl: time.Hour}
+
+	pia := NewWithOptions(srv.URL, opts)
+	regions, err := pia.GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+	_, err = pia.GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), srv.hits, "list fetched more than once by the same client")
+
+	entry := serverListCache{dir: opts.CacheDir}.load(srv.URL)
+	require.NotNil(t, entry)
+	require.Equal(t, "c2lnbmF0dXJl", entry.Signature)
+	require.Equal(t, `"v1"`, entry.ETag)
+
+	regions, err = NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+	require.Equal(t, int32(1), srv.hits, "fresh cache was not used")
+}
+
+func TestExpiredCacheIsRevalidated(t *testing.T) {
+	srv := newServerListServer()
+	defer srv.Close()
+	opts := Options{CacheDir: t.TempDir(), CacheTtl: 0}
+
+	_, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	regions, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+	require.Equal(t, int32(2), srv.hits)
+	require.Equal(t, int32(1), srv.conditional)
+}
+
+func TestOfflineMode(t *testing.T) {
+	srv := newServerListServer()
+	defer srv.Close()
+	opts := Options{CacheDir: t.TempDir(), CacheTtl: 0, Offline: true}
+
+	_, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.Error(t, err, "offline mode without a cache should fail")
+
+	opts.Offline = false
+	_, err = NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	srv.Close()
+
+	opts.Offline = true
+	regions, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+	require.Equal(t, int32(1), srv.hits)
+}
+
+func TestStaleCacheUsedWhenServerDown(t *testing.T) {
+	srv := newServerListServer()
+	opts := Options{CacheDir: t.TempDir(), CacheTtl: 0}
+	_, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	srv.Close()
+
+	regions, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+}
+
+func TestUnusableServerListIsNotCached(t *testing.T) {
+	portal := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&portal) == 1 {
+			w.Write([]byte("<html>captive portal</html>"))
+			return
+		}
+		w.Write([]byte(testServerList))
+	}))
+	defer srv.Close()
+	opts := Options{CacheDir: t.TempDir(), CacheTtl: 0}
+
+	atomic.StoreInt32(&portal, 1)
+	_, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.Error(t, err)
+	require.Nil(t, serverListCache{dir: opts.CacheDir}.load(srv.URL), "unusable list was cached")
+
+	atomic.StoreInt32(&portal, 0)
+	_, err = NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&portal, 1)
+	regions, err := NewWithOptions(srv.URL, opts).GetRegions()
+	require.NoError(t, err, "stale cached list should be used instead")
+	require.Equal(t, "ca_toronto", regions.Regions[0].Id)
+	require.Contains(t, serverListCache{dir: opts.CacheDir}.load(srv.URL).List, "ca_toronto")
+}
+
+func TestEmptyServerListIsRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"groups":{},"regions":[]}`))
+	}))
+	defer srv.Close()
+	_, err := NewWithOptions(srv.URL, Options{}).GetRegions()
+	require.True(t, errors.As(err, &ServerListError{}), "%v", err)
+}
+
+func TestServerListIsRefetchedAfterTtl(t *testing.T) {
+	srv := newServerListServer()
+	defer srv.Close()
+	pia := NewWithOptions(srv.URL, Options{CacheDir: t.TempDir(), CacheTtl: time.Hour})
+	_, err := pia.GetRegions()
+	require.NoError(t, err)
+	_, err = pia.GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), srv.hits)
+
+	// a long running client, i.e. the daemon's, picks up changes to the list once the ttl has passed
+	memo := pia.(piaClientImpl).regions
+	memo.fetchedOn = memo.fetchedOn.Add(-2 * time.Hour)
+	cache := serverListCache{dir: pia.(piaClientImpl).cache.dir}
+	entry := cache.load(srv.URL)
+	entry.FetchedOn = entry.FetchedOn.Add(-2 * time.Hour)
+	require.NoError(t, cache.save(entry))
+	_, err = pia.GetRegions()
+	require.NoError(t, err)
+	require.Equal(t, int32(2), srv.hits)
+	require.Equal(t, int32(1), srv.conditional)
+}
@@ -0,0 +1,97 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import "fmt"
+
+// AuthError is returned when PIA rejects the credentials
+type AuthError struct {
+	Region string // region whose meta server rejected them
+}
+
+func (err AuthError) Error() string {
+	return "invalid PIA credentials"
+}
+
+// UnknownRegionError is returned for a region id that isn't in the server list, or that has no servers
+type UnknownRegionError struct {
+	errMsg  string
+	Id      string
+	Offline bool // the region is in the server list but has no servers to connect to
+}
+
+func (err UnknownRegionError) Error() string {
+	return err.errMsg
+}
+
+func newUnknownRegionError(id string, offline bool) UnknownRegionError {
+	msg := fmt.Sprintf("unknown region id: %s", id)
+	if offline {
+		msg = fmt.Sprintf("region is offline: %s", id)
+	}
+	return UnknownRegionError{
+		errMsg:  msg,
+		Id:      id,
+		Offline: offline,
+	}
+}
+
+// ServerListError is returned when there's no usable server list: the one downloaded can't be parsed
+// or, in offline mode, none is cached
+type ServerListError struct {
+	Msg string
+	Err error // cause, if any
+}
+
+func (err ServerListError) Error() string {
+	if err.Err == nil {
+		return err.Msg
+	}
+	return fmt.Sprintf("%s: %v", err.Msg, err.Err)
+}
+
+func (err ServerListError) Unwrap() error {
+	return err.Err
+}
+
+// AddKeyError is returned when a region's wg server refuses to register a key; Status and Message are
+// what the server answered with
+type AddKeyError struct {
+	Region  string
+	Status  string
+	Message string
+}
+
+func (err AddKeyError) Error() string {
+	return fmt.Sprintf("addKey rejected by %s: %s %s", err.Region, err.Status, err.Message)
+}
+
+// NetworkError is returned when a PIA server can't be reached or doesn't give a usable answer;
+// trying again later may well work
+type NetworkError struct {
+	Op  string // what failed, i.e. token fetch
+	Err error
+}
+
+func (err NetworkError) Error() string {
+	return fmt.Sprintf("%s failed: %v", err.Op, err.Err)
+}
+
+func (err NetworkError) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,117 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient/piatest"
+)
+
+func TestTypedErrors(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	pia := piaclient.NewWithOptions(piatest.ServerListUrl, piaclient.Options{Transport: srv.Transport})
+
+	_, err := pia.CreateTunnel(piatest.Id, "wrong-password", "ca_toronto")
+	var authErr piaclient.AuthError
+	require.True(t, errors.As(err, &authErr), "%v", err)
+	require.Equal(t, "ca_toronto", authErr.Region)
+
+	_, err = pia.CreateTunnel(piatest.Id, piatest.Password, "nowhere")
+	var regionErr piaclient.UnknownRegionError
+	require.True(t, errors.As(err, &regionErr), "%v", err)
+	require.Equal(t, "nowhere", regionErr.Id)
+	require.False(t, regionErr.Offline)
+
+	_, err = pia.CreateTunnelWithToken("not-a-token", "us_east")
+	var addKeyErr piaclient.AddKeyError
+	require.True(t, errors.As(err, &addKeyErr), "%v", err)
+	require.Equal(t, piaclient.AddKeyError{Region: "us_east", Status: "ERROR", Message: "Login failed!"}, addKeyErr)
+
+	_, err = pia.CreateTunnel(piatest.SuspendedId, piatest.Password, "ca_toronto")
+	require.True(t, errors.As(err, &authErr), "%v", err)
+
+	srv.Close()
+	_, err = pia.CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	var netErr piaclient.NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "token fetch", netErr.Op)
+}
+
+func TestPortForwardErrors(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	pia := piaclient.NewWithOptions(piatest.ServerListUrl, piaclient.Options{Transport: srv.Transport})
+	iface, err := pia.CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	require.NoError(t, err)
+
+	srv.Fail("/getSignature", http.StatusBadGateway)
+	_, err = pia.GetPortForward(piatest.Id, piatest.Password, iface)
+	var netErr piaclient.NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "getSignature", netErr.Op)
+
+	pf, err := pia.GetPortForward(piatest.Id, piatest.Password, iface)
+	require.NoError(t, err)
+	srv.Fail("/bindPort", http.StatusBadGateway)
+	err = pia.BindPort(iface, pf)
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "bindPort", netErr.Op)
+
+	srv.Close()
+	err = pia.BindPort(iface, pf)
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "bindPort", netErr.Op)
+}
+
+func TestServerListErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>captive portal</html>"))
+	}))
+	defer srv.Close()
+	_, err := piaclient.New(srv.URL).GetRegions()
+	var listErr piaclient.ServerListError
+	require.True(t, errors.As(err, &listErr), "%v", err)
+
+	_, err = piaclient.NewWithOptions(srv.URL, piaclient.Options{CacheDir: t.TempDir(), Offline: true}).GetRegions()
+	require.True(t, errors.As(err, &listErr), "%v", err)
+
+	srv.Close()
+	_, err = piaclient.New(srv.URL).GetRegions()
+	var netErr piaclient.NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "region url fetch", netErr.Op)
+}
+
+func TestOfflineRegion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"regions":[{"id":"down","name":"Down","servers":{}}]}`))
+	}))
+	defer srv.Close()
+	_, err := piaclient.New(srv.URL).CreateTunnel(piatest.Id, piatest.Password, "down")
+	var regionErr piaclient.UnknownRegionError
+	require.True(t, errors.As(err, &regionErr), "%v", err)
+	require.True(t, regionErr.Offline)
+	require.EqualError(t, err, "region is offline: down")
+}
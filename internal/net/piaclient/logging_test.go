@@ -0,0 +1,67 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient/piatest"
+	"k8s.io/klog/v2"
+)
+
+func TestSecretsAreNotLogged(t *testing.T) {
+	for _, format := range []string{logging.FormatText, logging.FormatJson} {
+		t.Run(format, func(t *testing.T) {
+			testSecretsAreNotLogged(t, format)
+		})
+	}
+}
+
+func testSecretsAreNotLogged(t *testing.T, format string) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	var logged bytes.Buffer
+	logging.Init(&logged, 10, format)
+	defer logging.Init(&bytes.Buffer{}, 0, logging.FormatText)
+
+	pia := piaclient.NewWithOptions(piatest.ServerListUrl, piaclient.Options{Transport: srv.Transport})
+	iface, err := pia.CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	require.NoError(t, err)
+	token, err := pia.Authenticate(piatest.Id, piatest.Password, "ca_toronto")
+	require.NoError(t, err)
+	other, err := pia.CreateTunnelWithToken(token, "us_east")
+	require.NoError(t, err)
+	pf, err := pia.GetPortForward(piatest.Id, piatest.Password, iface)
+	require.NoError(t, err)
+	require.NoError(t, pia.BindPort(iface, pf))
+	_, err = pia.CreateTunnel(piatest.Id, "wrong-password", "ca_toronto")
+	require.Error(t, err)
+	klog.Flush()
+
+	out := logged.String()
+	require.Contains(t, out, "generateToken", "resty's request dump is missing")
+	for _, secret := range []string{piatest.Password, piatest.Token, piatest.Signature, iface.ClientPrivateKey, other.ClientPrivateKey, "wrong-password"} {
+		require.NotContains(t, out, secret)
+	}
+	require.False(t, strings.Contains(out, "Basic cDEyMzQ1Njc6"), "basic auth header logged")
+}
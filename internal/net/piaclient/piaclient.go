@@ -18,33 +18,48 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package piaclient
 
 import (
+	"context"
 	"crypto/tls"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/metrics"
+	"gitlab.com/ddb_db/piawgcli/internal/utils/os"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-	"k8s.io/klog/v2"
 )
 
 //https://github.com/go-resty/resty
 
+var log = logging.Component("piaclient")
+
 type PiaClient interface {
 	CreateTunnel(piaId string, piaPassword string, piaRegionId string) (PiaInterface, error)
+	CreateTunnelWithKey(piaId string, piaPassword string, piaRegionId string, privKey wgtypes.Key) (PiaInterface, error)
+	Authenticate(piaId string, piaPassword string, piaRegionId string) (string, error)
+	CreateTunnelWithToken(authToken string, piaRegionId string) (PiaInterface, error)
 	GetRegions() (PiaRegions, error)
+	GetPortForward(piaId string, piaPassword string, iface PiaInterface) (PortForward, error)
+	BindPort(iface PiaInterface, pf PortForward) error
 	getAuthToken(piaId string, piaPassword string, piaRegion PiaRegion) (string, error)
 	getRegionById(id string) (PiaRegion, error)
 }
 
 type PiaRegion struct {
-	Id      string
-	Name    string
-	Dns     string
-	Servers PiaServers
-	Ping    uint16
+	Id          string
+	Name        string
+	Dns         string
+	PortForward bool `json:"port_forward"`
+	Servers     PiaServers
+	Ping        os.PingResult `json:"-"`
 }
 
 type PiaServers struct {
@@ -64,10 +79,48 @@ type PiaRegions struct {
 type piaClientImpl struct {
 	regionUrl string
 	http      map[string]*resty.Client
+	httpLock  *sync.Mutex
+	cache     serverListCache
+	offline   bool
+	regions   *regionsMemo
+	transport http.RoundTripper
+	proxy     *url.URL
+	timeout   time.Duration
+	retries   int
+	retryWait time.Duration
+	ctx       context.Context
+}
+
+// Options tune how the client talks to PIA
+type Options struct {
+	CacheDir string        // where the server list is cached; caching is disabled when empty
+	CacheTtl time.Duration // how long a cached server list is used before checking for a newer one
+	Offline  bool          // never download the server list, only use the cached copy
+	Timeout  time.Duration // how long a request may take; DefaultTimeout when zero
+	// Retries is how many times the server list, token and addKey requests are retried when PIA can't
+	// be reached, times out or fails internally; RetryWait, or DefaultRetryWait when zero, is the wait
+	// before the first retry
+	Retries   int
+	RetryWait time.Duration
+	// Context cuts the wait between retries short when it's cancelled; context.Background() when nil
+	Context context.Context
+	// Proxy is the http(s):// or socks5:// proxy every request is sent through; when nil, HTTPS_PROXY
+	// and friends are used, if set
+	Proxy *url.URL
+	// Transport replaces the transport, and so the certificate pinning, of every request; tests point it at a fake PIA
+	Transport http.RoundTripper
 }
 
-type UnknownRegionError struct {
-	errMsg string
+// minRegionsTtl is the least time the server list is held in memory, so one command fetches it once even
+// when the cache ttl is 0
+const minRegionsTtl = time.Minute
+
+// regionsMemo holds the server list once it's been fetched so a client only fetches it again, for long
+// running commands, once the cache ttl has passed
+type regionsMemo struct {
+	lock      sync.Mutex
+	regions   *PiaRegions
+	fetchedOn time.Time
 }
 
 type PiaInterface struct {
@@ -76,6 +129,7 @@ type PiaInterface struct {
 	ServerPort       uint16   `json:"server_port"`
 	ServerEndpoint   string   `json:"server_ip"`
 	ServerVirtualIp  string   `json:"server_vip"`
+	ServerCn         string   `json:"-"`
 	ClientIp         string   `json:"peer_ip"`
 	ClientPublicKey  string   `json:"peer_pubkey"`
 	DnsServers       []string `json:"dns_servers"`
@@ -87,79 +141,280 @@ type PiaInterface struct {
 //go:embed assets/pia.pem
 var piaPem string
 
-func (err UnknownRegionError) Error() string {
-	return err.errMsg
-}
-
-func newUnknownRegionError(msg string) UnknownRegionError {
-	return UnknownRegionError{
-		errMsg: msg,
-	}
+func New(serverListUrl string) PiaClient {
+	return NewWithOptions(serverListUrl, Options{})
 }
 
-func New(serverListUrl string) PiaClient {
+func NewWithOptions(serverListUrl string, opts Options) PiaClient {
 	c := piaClientImpl{
 		regionUrl: serverListUrl,
 		http:      make(map[string]*resty.Client),
+		httpLock:  &sync.Mutex{},
+		cache: serverListCache{
+			dir: opts.CacheDir,
+			ttl: opts.CacheTtl,
+		},
+		offline:   opts.Offline,
+		regions:   &regionsMemo{},
+		transport: opts.Transport,
+		proxy:     opts.Proxy,
+		timeout:   opts.Timeout,
+		retries:   opts.Retries,
+		retryWait: opts.RetryWait,
+		ctx:       opts.Context,
+	}
+	if c.timeout <= 0 {
+		c.timeout = DefaultTimeout
+	}
+	if c.retryWait <= 0 {
+		c.retryWait = DefaultRetryWait
+	}
+	if c.ctx == nil {
+		c.ctx = context.Background()
+	}
+	if c.proxy != nil {
+		if pwd, ok := c.proxy.User.Password(); ok {
+			logging.AddSecret(pwd)
+		}
+		log.V(4).Info("using proxy", "proxy", c.proxy.Redacted())
 	}
-	c.http["_"] = resty.New()
+	c.http["_"] = c.newHttp(nil, true)
 	return c
 }
 
+// ValidateProxy returns an error when u isn't a proxy the client can use
+func ValidateProxy(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return nil
+	}
+	return fmt.Errorf("unsupported proxy scheme %q; use http, https or socks5", u.Scheme)
+}
+
+// newHttp returns a client that logs through klog, dumping every request and response at -debug 6 and up;
+// the dumps hold credentials and tokens, which the log redacts; through a proxy, TLS is still negotiated
+// with the PIA server itself, over a CONNECT or socks5 tunnel, so tlsConfig's pinning still applies; a
+// client that isn't proxied ignores HTTPS_PROXY and friends too
+func (clnt piaClientImpl) newHttp(tlsConfig *tls.Config, proxied bool) *resty.Client {
+	c := resty.New().
+		SetLogger(restyLogger{}).
+		SetDebug(log.V(6).Enabled()).
+		SetDebugBodyLimit(4096).
+		SetTimeout(clnt.timeout)
+	if clnt.transport != nil {
+		return c.SetTransport(clnt.transport)
+	}
+	if !proxied {
+		c.RemoveProxy()
+	} else if clnt.proxy != nil {
+		c.SetProxy(clnt.proxy.String())
+	}
+	if tlsConfig != nil {
+		c.SetTLSClientConfig(tlsConfig).
+			SetRootCertificateFromString(piaPem)
+	}
+	return c
+}
+
+// restyLogger sends resty's log to klog instead of stderr
+type restyLogger struct{}
+
+func (restyLogger) Errorf(format string, v ...interface{}) {
+	log.Error(nil, fmt.Sprintf(format, v...))
+}
+
+func (restyLogger) Warnf(format string, v ...interface{}) {
+	log.Warning(fmt.Sprintf(format, v...))
+}
+
+func (restyLogger) Debugf(format string, v ...interface{}) {
+	log.V(6).Info(fmt.Sprintf(format, v...))
+}
+
+// logRequest logs how long a PIA api request took and whether it failed
+func logRequest(request string, region string, took time.Duration, err error) {
+	kv := []interface{}{"request", request, logging.KeyDuration, took}
+	if len(region) > 0 {
+		kv = append(kv, logging.KeyRegion, region)
+	}
+	if err != nil {
+		kv = append(kv, logging.KeyError, err)
+	}
+	log.V(4).Info("pia request", kv...)
+}
+
 func (clnt piaClientImpl) getDefaultHttp() *resty.Client {
 	return clnt.http["_"]
 }
 
 func (clnt piaClientImpl) getHttpForRegion(region PiaRegion) *resty.Client {
-	c := clnt.http[region.Id]
+	return clnt.getHttpForServer(region.Servers.Meta[0].Cn)
+}
+
+// getHttpForServer returns a client that only trusts the PIA server with the given common name
+func (clnt piaClientImpl) getHttpForServer(cn string) *resty.Client {
+	return clnt.getHttp(cn, cn, true)
+}
+
+// getHttpForTunnel returns a client, never proxied, that only trusts the PIA server with the given common
+// name; it's for requests to the server's virtual ip, which is only reachable through the tunnel itself
+func (clnt piaClientImpl) getHttpForTunnel(cn string) *resty.Client {
+	return clnt.getHttp("tunnel/"+cn, cn, false)
+}
+
+func (clnt piaClientImpl) getHttp(key string, cn string, proxied bool) *resty.Client {
+	clnt.httpLock.Lock()
+	defer clnt.httpLock.Unlock()
+	c := clnt.http[key]
 	if c == nil {
-		c = resty.New().
-			SetTLSClientConfig(&tls.Config{
-				ServerName: region.Servers.Meta[0].Cn,
-			}).
-			SetRootCertificateFromString(piaPem)
-		clnt.http[region.Id] = c
+		c = clnt.newHttp(&tls.Config{
+			ServerName: cn,
+		}, proxied)
+		clnt.http[key] = c
 	}
 	return c
 }
 
 func (clnt piaClientImpl) getAuthToken(id string, pwd string, region PiaRegion) (string, error) {
+	var token string
+	err := clnt.retry(clnt.ctx, "generateToken", region.Id, func() error {
+		start := time.Now()
+		var err error
+		token, err = clnt.fetchAuthToken(id, pwd, region)
+		took := time.Since(start)
+		metrics.ObservePiaRequest("generateToken", region.Id, took, err)
+		logRequest("generateToken", region.Id, took, err)
+		return err
+	})
+	return token, err
+}
+
+func (clnt piaClientImpl) fetchAuthToken(id string, pwd string, region PiaRegion) (string, error) {
+	logging.AddSecret(pwd)
 	url := fmt.Sprintf("https://%s/authv3/generateToken", region.Servers.Meta[0].Ip)
 	resp, err := clnt.getHttpForRegion(region).R().
 		SetBasicAuth(id, pwd).
 		Get(url)
 	if err != nil {
-		err = fmt.Errorf("token fetch failed: %w", err)
-		return "", err
+		return "", NetworkError{"token fetch", err}
 	}
 	httpStatus := resp.StatusCode()
-	if httpStatus == 403 {
-		return "", fmt.Errorf("invalid PIA credentials")
+	if httpStatus == 401 || httpStatus == 403 {
+		return "", AuthError{region.Id}
 	}
 	if httpStatus < 200 || httpStatus > 299 {
-		return "", fmt.Errorf("invalid auth token response: %d", httpStatus)
+		return "", NetworkError{"token fetch", unexpectedResponse(resp)}
 	}
-	klog.V(4).Info(resp.String())
 	var jsonResp struct {
 		Status string
 		Token  string
 	}
 	err = json.Unmarshal(resp.Body(), &jsonResp)
 	if err != nil {
-		return "", fmt.Errorf("json parse of auth token failed: %w", err)
+		return "", NetworkError{"token fetch", fmt.Errorf("json parse of auth token failed: %w", err)}
 	}
+	logging.AddSecret(jsonResp.Token)
+	log.V(4).Info("generateToken response", logging.KeyRegion, region.Id, "body", resp.String())
 	if jsonResp.Status != "OK" {
-		err = fmt.Errorf("invalid auth token response: %s [%d]", jsonResp.Status, resp.StatusCode())
+		// the meta server answers bad credentials this way too, not only with a 401
+		log.V(1).Info("auth token rejected", logging.KeyRegion, region.Id, "status", jsonResp.Status)
+		return "", AuthError{region.Id}
 	}
-	return jsonResp.Token, err
+	return jsonResp.Token, nil
 }
 
 func (clnt piaClientImpl) GetRegions() (PiaRegions, error) {
-	resp, err := clnt.getDefaultHttp().R().Get(clnt.regionUrl)
+	clnt.regions.lock.Lock()
+	defer clnt.regions.lock.Unlock()
+	ttl := clnt.cache.ttl
+	if ttl < minRegionsTtl {
+		ttl = minRegionsTtl
+	}
+	if clnt.regions.regions != nil && time.Since(clnt.regions.fetchedOn) < ttl {
+		return *clnt.regions.regions, nil
+	}
+	entry, err := clnt.fetchServerList()
+	if err != nil {
+		return PiaRegions{}, err
+	}
+	regions, err := parsePiaRegionJsonBody(entry.List)
+	if err == nil {
+		clnt.regions.regions = &regions
+		clnt.regions.fetchedOn = time.Now()
+	}
+	return regions, err
+}
+
+// fetchServerList returns the server list from the cache when it's fresh, otherwise from the server list url
+func (clnt piaClientImpl) fetchServerList() (*cachedServerList, error) {
+	cached := clnt.cache.load(clnt.regionUrl)
+	if clnt.offline {
+		if cached == nil {
+			return nil, ServerListError{Msg: "offline mode: no cached server list available"}
+		}
+		log.V(4).Info("offline mode: using cached server list", "fetchedOn", cached.FetchedOn)
+		return cached, nil
+	}
+	if clnt.cache.fresh(cached) {
+		log.V(4).Info("using cached server list", "fetchedOn", cached.FetchedOn)
+		return cached, nil
+	}
+	var resp *resty.Response
+	err := clnt.retry(clnt.ctx, "serverList", "", func() error {
+		req := clnt.getDefaultHttp().R()
+		if cached != nil {
+			if len(cached.ETag) > 0 {
+				req.SetHeader("If-None-Match", cached.ETag)
+			}
+			if len(cached.LastModified) > 0 {
+				req.SetHeader("If-Modified-Since", cached.LastModified)
+			}
+		}
+		start := time.Now()
+		var err error
+		resp, err = req.Get(clnt.regionUrl)
+		logRequest("serverList", "", time.Since(start), err)
+		if err != nil {
+			return NetworkError{"region url fetch", err}
+		}
+		if (resp.StatusCode() < 200 || resp.StatusCode() > 299) && !(resp.StatusCode() == http.StatusNotModified && cached != nil) {
+			return NetworkError{"region url fetch", unexpectedResponse(resp)}
+		}
+		return nil
+	})
 	if err != nil {
-		return PiaRegions{}, fmt.Errorf("region url fetch failed: %w", err)
+		if cached != nil && !errors.As(err, &statusError{}) {
+			log.Warning("region url fetch failed, using stale cached server list", "fetchedOn", cached.FetchedOn, logging.KeyError, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	entry := cached
+	if resp.StatusCode() == http.StatusNotModified {
+		log.V(4).Info("server list not modified since last fetch")
+	} else {
+		list, signature := splitServerList(resp.String())
+		// a captive portal or truncated download must not replace a good list, in the cache or otherwise
+		if _, err = parsePiaRegionJsonBody(list); err != nil {
+			if cached != nil {
+				log.Warning("downloaded server list is unusable, using stale cached server list", "fetchedOn", cached.FetchedOn, logging.KeyError, err)
+				return cached, nil
+			}
+			return nil, err
+		}
+		entry = &cachedServerList{
+			Url:          clnt.regionUrl,
+			ETag:         resp.Header().Get("ETag"),
+			LastModified: resp.Header().Get("Last-Modified"),
+			List:         list,
+			Signature:    signature,
+		}
 	}
-	return parsePiaRegionJsonBody(resp.String())
+	entry.FetchedOn = time.Now()
+	if err = clnt.cache.save(entry); err != nil {
+		log.Warning("unable to cache server list", logging.KeyError, err)
+	}
+	return entry, nil
 }
 
 func (clnt piaClientImpl) getRegionById(id string) (PiaRegion, error) {
@@ -168,11 +423,15 @@ func (clnt piaClientImpl) getRegionById(id string) (PiaRegion, error) {
 		return PiaRegion{}, err
 	}
 	for _, r := range regions.Regions {
-		if r.Id == id && len(r.Servers.Meta[0].Ip) > 0 && len(r.Servers.Wg[0].Ip) > 0 {
-			return r, nil
+		if r.Id != id {
+			continue
+		}
+		if len(r.Servers.Meta) == 0 || len(r.Servers.Wg) == 0 || len(r.Servers.Meta[0].Ip) == 0 || len(r.Servers.Wg[0].Ip) == 0 {
+			return PiaRegion{}, newUnknownRegionError(id, true)
 		}
+		return r, nil
 	}
-	return PiaRegion{}, newUnknownRegionError(fmt.Sprintf("unknown region id: %s", id))
+	return PiaRegion{}, newUnknownRegionError(id, false)
 }
 
 func (clnt piaClientImpl) CreateTunnel(piaId string, piaPwd string, piaRegionId string) (PiaInterface, error) {
@@ -180,7 +439,12 @@ func (clnt piaClientImpl) CreateTunnel(piaId string, piaPwd string, piaRegionId
 	if err != nil {
 		return PiaInterface{}, fmt.Errorf("wg key generation failed: %w", err)
 	}
-	pubKey := privKey.PublicKey()
+	return clnt.CreateTunnelWithKey(piaId, piaPwd, piaRegionId, privKey)
+}
+
+// CreateTunnelWithKey registers an existing key with the region; re-registering a key keeps
+// an interface that's already using it working after PIA has dropped it
+func (clnt piaClientImpl) CreateTunnelWithKey(piaId string, piaPwd string, piaRegionId string, privKey wgtypes.Key) (PiaInterface, error) {
 	r, err := clnt.getRegionById(piaRegionId)
 	if err != nil {
 		return PiaInterface{}, err
@@ -189,37 +453,101 @@ func (clnt piaClientImpl) CreateTunnel(piaId string, piaPwd string, piaRegionId
 	if err != nil {
 		return PiaInterface{}, err
 	}
+	return clnt.createTunnel(r, authToken, privKey)
+}
+
+// Authenticate fetches an auth token through the region's meta server; the token is good for
+// registering keys with any region
+func (clnt piaClientImpl) Authenticate(piaId string, piaPwd string, piaRegionId string) (string, error) {
+	r, err := clnt.getRegionById(piaRegionId)
+	if err != nil {
+		return "", err
+	}
+	return clnt.getAuthToken(piaId, piaPwd, r)
+}
+
+// CreateTunnelWithToken registers a new key with the region using a token from Authenticate
+func (clnt piaClientImpl) CreateTunnelWithToken(authToken string, piaRegionId string) (PiaInterface, error) {
+	logging.AddSecret(authToken)
+	privKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return PiaInterface{}, fmt.Errorf("wg key generation failed: %w", err)
+	}
+	r, err := clnt.getRegionById(piaRegionId)
+	if err != nil {
+		return PiaInterface{}, err
+	}
+	return clnt.createTunnel(r, authToken, privKey)
+}
+
+func (clnt piaClientImpl) createTunnel(r PiaRegion, authToken string, privKey wgtypes.Key) (PiaInterface, error) {
+	logging.AddSecret(privKey.String())
+	var iface PiaInterface
+	err := clnt.retry(clnt.ctx, "addKey", r.Id, func() error {
+		start := time.Now()
+		var err error
+		iface, err = clnt.addKey(r, privKey.PublicKey(), authToken)
+		took := time.Since(start)
+		metrics.ObservePiaRequest("addKey", r.Id, took, err)
+		logRequest("addKey", r.Id, took, err)
+		return err
+	})
+	if err != nil {
+		return PiaInterface{}, err
+	}
+	iface.ClientPrivateKey = privKey.String()
+	iface.ServerCn = r.Servers.Wg[0].Cn
+	iface.PiaRegion = r
+	iface.CreatedOn = time.Now().Format(time.UnixDate)
+	return iface, nil
+}
+
+func (clnt piaClientImpl) addKey(r PiaRegion, pubKey wgtypes.Key, authToken string) (PiaInterface, error) {
 	url := fmt.Sprintf("https://%s:1337/addKey", r.Servers.Wg[0].Ip)
-	http := clnt.getHttpForRegion(r)
-	resp, err := http.R().
+	resp, err := clnt.getHttpForRegion(r).R().
 		SetQueryParams(map[string]string{
 			"pubkey": pubKey.String(),
 			"pt":     authToken,
 		}).Get(url)
 	if err != nil {
-		return PiaInterface{}, fmt.Errorf("addKey failed: %w", err)
+		return PiaInterface{}, NetworkError{"addKey", err}
 	}
-	iface := PiaInterface{}
-	err = json.Unmarshal(resp.Body(), &iface)
-	if err != nil || iface.Status != "OK" {
-		return PiaInterface{}, fmt.Errorf("error parsing addKey response: %w", err)
+	if resp.StatusCode() >= 500 || resp.StatusCode() == http.StatusTooManyRequests {
+		return PiaInterface{}, NetworkError{"addKey", unexpectedResponse(resp)}
 	}
-	iface.ClientPrivateKey = privKey.String()
-	iface.PiaRegion = r
-	iface.CreatedOn = time.Now().Format(time.UnixDate)
-	return iface, nil
+	var jsonResp struct {
+		PiaInterface
+		Message string // why the key was rejected
+	}
+	if err = json.Unmarshal(resp.Body(), &jsonResp); err != nil {
+		return PiaInterface{}, NetworkError{"addKey", fmt.Errorf("error parsing addKey response: %w", err)}
+	}
+	if jsonResp.Status != "OK" {
+		return PiaInterface{}, AddKeyError{Region: r.Id, Status: jsonResp.Status, Message: jsonResp.Message}
+	}
+	return jsonResp.PiaInterface, nil
 }
 
-func parsePiaRegionJsonBody(payload string) (PiaRegions, error) {
+// splitServerList separates the json region data from the signature that follows it
+func splitServerList(payload string) (string, string) {
 	// the endpoint pads the json response with an undocumented signature blob of some kind so we must extract out only the json data in the response
 	lastBrace := strings.LastIndex(payload, "}")
-	klog.V(4).Infof("last brace: %d", lastBrace)
-	body := []byte(payload[0 : lastBrace+1])
-	klog.V(4).Infof("region payload: %s", body[:70])
+	log.V(4).Info("split server list", "lastBrace", lastBrace)
+	return payload[0 : lastBrace+1], strings.TrimSpace(payload[lastBrace+1:])
+}
+
+func parsePiaRegionJsonBody(payload string) (PiaRegions, error) {
+	list, _ := splitServerList(payload)
+	body := []byte(list)
+	if len(body) > 70 {
+		log.V(4).Info("region payload", "head", string(body[:70]))
+	}
 	val := PiaRegions{}
 	err := json.Unmarshal(body, &val)
 	if err != nil {
-		err = fmt.Errorf("region data parse failed: %w", err)
+		err = ServerListError{"region data parse failed", err}
+	} else if len(val.Regions) == 0 {
+		err = ServerListError{Msg: "server list has no regions"}
 	}
 	return val, err
 }
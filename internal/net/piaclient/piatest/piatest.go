@@ -0,0 +1,182 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package piatest is a fake PIA for tests: it serves the server list and the token, key and port
+// forwarding apis to any client using its Transport, whatever host the client asks for
+package piatest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// the secrets the fake hands out or expects
+const (
+	Id        = "p1234567"
+	Password  = "fake-pia-password-xyzzy"
+	Token     = "fakeauthtoken0123456789abcdefabcdef"
+	Signature = "fakeportsignature9876543210fedcba"
+)
+
+// SuspendedId is an account whose credentials are right but that's refused a token anyway, with an
+// ERROR status rather than an http error
+const SuspendedId = "p7654321"
+
+// ServerListUrl is the server list's url; like every other url it's served by the fake
+const ServerListUrl = "https://serverlist.piaservers.net/vpninfo/servers/v4"
+
+// Port is the port handed out by getSignature
+const Port = 47047
+
+const serverList = `{"groups":{},"regions":[` +
+	`{"id":"ca_toronto","name":"CA Toronto","dns":"ca-toronto.privacy.network","port_forward":true,` +
+	`"servers":{"meta":[{"ip":"10.11.0.1","cn":"toronto401"}],"wg":[{"ip":"10.11.0.2","cn":"toronto401"}]}},` +
+	`{"id":"us_east","name":"US East","dns":"us-east.privacy.network","port_forward":false,` +
+	`"servers":{"meta":[{"ip":"10.12.0.1","cn":"newjersey402"}],"wg":[{"ip":"10.12.0.2","cn":"newjersey402"}]}}` +
+	"]}\n\nc2lnbmF0dXJl\n"
+
+// Server is a fake PIA
+type Server struct {
+	*httptest.Server
+	// Transport sends every request to the fake; give it to piaclient.Options
+	Transport http.RoundTripper
+
+	lock   sync.Mutex
+	faults map[string][]int
+	hits   map[string]int
+}
+
+// Fail makes the next requests for path answer with the given http statuses, one request per status;
+// a status of 0 stalls the request until the client gives up on it
+func (s *Server) Fail(path string, statuses ...int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults[path] = append(s.faults[path], statuses...)
+}
+
+// Hits returns how many requests for path the fake has received
+func (s *Server) Hits(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hits[path]
+}
+
+// fault counts a request and returns the status it should fail with, if any
+func (s *Server) fault(path string) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hits[path]++
+	statuses := s.faults[path]
+	if len(statuses) == 0 {
+		return 0, false
+	}
+	s.faults[path] = statuses[1:]
+	return statuses[0], true
+}
+
+func NewServer() *Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vpninfo/servers/v4", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(serverList))
+	})
+	mux.HandleFunc("/authv3/generateToken", func(w http.ResponseWriter, r *http.Request) {
+		id, pwd, ok := r.BasicAuth()
+		if ok && id == SuspendedId && pwd == Password {
+			writeJson(w, map[string]string{"status": "ERROR", "message": "account suspended"})
+			return
+		}
+		if !ok || id != Id || pwd != Password {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeJson(w, map[string]string{"status": "OK", "token": Token})
+	})
+	mux.HandleFunc("/addKey", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pt") != Token {
+			writeJson(w, map[string]string{"status": "ERROR", "message": "Login failed!"})
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.Host)
+		writeJson(w, map[string]interface{}{
+			"status":      "OK",
+			"server_key":  "dGhpcyBpcyB0aGUgc2VydmVyIHB1YmxpYyBrZXkgISE=",
+			"server_port": 1337,
+			"server_ip":   host,
+			"server_vip":  "10.0.0.1",
+			"peer_ip":     "10.1.2.3",
+			"peer_pubkey": r.URL.Query().Get("pubkey"),
+			"dns_servers": []string{"10.0.0.243"},
+		})
+	})
+	mux.HandleFunc("/getSignature", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != Token {
+			writeJson(w, map[string]string{"status": "ERROR", "message": "bad token"})
+			return
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"token":      "payloadtoken",
+			"port":       Port,
+			"expires_at": time.Now().Add(60 * 24 * time.Hour),
+		})
+		writeJson(w, map[string]string{
+			"status":    "OK",
+			"payload":   base64.StdEncoding.EncodeToString(payload),
+			"signature": Signature,
+		})
+	})
+	mux.HandleFunc("/bindPort", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") != Signature {
+			writeJson(w, map[string]string{"status": "ERROR", "message": "bad signature"})
+			return
+		}
+		writeJson(w, map[string]string{"status": "OK", "message": "port scheduled for add"})
+	})
+	s := &Server{faults: map[string][]int{}, hits: map[string]int{}}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, failed := s.fault(r.URL.Path)
+		if !failed {
+			mux.ServeHTTP(w, r)
+		} else if status == 0 {
+			<-r.Context().Done()
+		} else {
+			w.WriteHeader(status)
+		}
+	}))
+	addr := s.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	s.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return s
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(fmt.Sprintf("piatest: %v", err))
+	}
+}
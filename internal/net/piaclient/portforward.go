@@ -0,0 +1,121 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+// the port forwarding api is served by the wg server, on its virtual ip, so is only reachable through the tunnel
+const portForwardApiPort = 19999
+
+// PortForward is a port the PIA wg server forwards to the client; Payload and Signature
+// must be presented to the server to (re)bind the port until it expires
+type PortForward struct {
+	Port      uint16
+	ExpiresAt time.Time
+	Payload   string
+	Signature string
+}
+
+func (clnt piaClientImpl) GetPortForward(piaId string, piaPwd string, iface PiaInterface) (PortForward, error) {
+	authToken, err := clnt.getAuthToken(piaId, piaPwd, iface.PiaRegion)
+	if err != nil {
+		return PortForward{}, err
+	}
+	url := fmt.Sprintf("https://%s:%d/getSignature", iface.ServerVirtualIp, portForwardApiPort)
+	start := time.Now()
+	resp, err := clnt.getHttpForTunnel(iface.ServerCn).R().
+		SetQueryParam("token", authToken).
+		Get(url)
+	logRequest("getSignature", iface.PiaRegion.Id, time.Since(start), err)
+	if err != nil {
+		return PortForward{}, NetworkError{"getSignature", err}
+	}
+	var jsonResp struct {
+		Status    string
+		Message   string
+		Payload   string
+		Signature string
+	}
+	err = json.Unmarshal(resp.Body(), &jsonResp)
+	if err != nil {
+		return PortForward{}, NetworkError{"getSignature", fmt.Errorf("json parse of getSignature response failed: %w", err)}
+	}
+	if jsonResp.Status != "OK" {
+		return PortForward{}, fmt.Errorf("getSignature failed: %s %s [%d]", jsonResp.Status, jsonResp.Message, resp.StatusCode())
+	}
+	return parsePortForwardPayload(jsonResp.Payload, jsonResp.Signature)
+}
+
+func (clnt piaClientImpl) BindPort(iface PiaInterface, pf PortForward) error {
+	url := fmt.Sprintf("https://%s:%d/bindPort", iface.ServerVirtualIp, portForwardApiPort)
+	start := time.Now()
+	resp, err := clnt.getHttpForTunnel(iface.ServerCn).R().
+		SetQueryParams(map[string]string{
+			"payload":   pf.Payload,
+			"signature": pf.Signature,
+		}).Get(url)
+	logRequest("bindPort", iface.PiaRegion.Id, time.Since(start), err)
+	if err != nil {
+		return NetworkError{"bindPort", err}
+	}
+	var jsonResp struct {
+		Status  string
+		Message string
+	}
+	err = json.Unmarshal(resp.Body(), &jsonResp)
+	if err != nil {
+		return NetworkError{"bindPort", fmt.Errorf("json parse of bindPort response failed: %w", err)}
+	}
+	if jsonResp.Status != "OK" {
+		return fmt.Errorf("bindPort failed: %s %s [%d]", jsonResp.Status, jsonResp.Message, resp.StatusCode())
+	}
+	log.V(4).Info("bindPort response", logging.KeyRegion, iface.PiaRegion.Id, "message", jsonResp.Message)
+	return nil
+}
+
+// parsePortForwardPayload decodes the port and expiry out of the base64 encoded json payload
+func parsePortForwardPayload(payload string, signature string) (PortForward, error) {
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return PortForward{}, fmt.Errorf("port forward payload decode failed: %w", err)
+	}
+	var data struct {
+		Port      uint16
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = json.Unmarshal(decoded, &data)
+	if err != nil {
+		return PortForward{}, fmt.Errorf("json parse of port forward payload failed: %w", err)
+	}
+	if data.Port == 0 {
+		return PortForward{}, fmt.Errorf("port forward payload has no port")
+	}
+	return PortForward{
+		Port:      data.Port,
+		ExpiresAt: data.ExpiresAt,
+		Payload:   payload,
+		Signature: signature,
+	}, nil
+}
@@ -0,0 +1,41 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortForwardPayload(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"token":"abc","port":47047,"expires_at":"2021-08-19T21:08:54.478940045Z"}`))
+	pf, err := parsePortForwardPayload(payload, "sig")
+	require.NoError(t, err)
+	require.Equal(t, uint16(47047), pf.Port)
+	require.Equal(t, time.Date(2021, 8, 19, 21, 8, 54, 478940045, time.UTC), pf.ExpiresAt)
+	require.Equal(t, payload, pf.Payload)
+	require.Equal(t, "sig", pf.Signature)
+
+	_, err = parsePortForwardPayload("not base64!", "sig")
+	require.Error(t, err)
+	_, err = parsePortForwardPayload(base64.StdEncoding.EncodeToString([]byte(`{"token":"abc"}`)), "sig")
+	require.Error(t, err)
+}
@@ -0,0 +1,114 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+const (
+	// DefaultTimeout is how long a PIA api request may take when Options doesn't say
+	DefaultTimeout = 30 * time.Second
+	// DefaultRetryWait is the wait before the first retry when Options doesn't say; it doubles with each retry
+	DefaultRetryWait = time.Second
+	// maxRetryWait caps the wait between retries
+	maxRetryWait = 30 * time.Second
+)
+
+// statusError is the cause of a NetworkError when a PIA server answers with an unexpected http status
+type statusError struct {
+	status int
+	text   string
+}
+
+func (err statusError) Error() string {
+	return fmt.Sprintf("unexpected response: %s", err.text)
+}
+
+func unexpectedResponse(resp *resty.Response) statusError {
+	return statusError{resp.StatusCode(), resp.Status()}
+}
+
+// retryable tells whether a failed request may work if it's sent again: the server couldn't be reached,
+// timed out, is overloaded or failed internally; a server answering, but not with what's wanted, will
+// answer the same way again
+func retryable(err error) bool {
+	var status statusError
+	if errors.As(err, &status) {
+		return status.status >= 500 || status.status == http.StatusTooManyRequests
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+	// a certificate that isn't trusted won't become trusted
+	return !errors.As(err, &x509.UnknownAuthorityError{}) &&
+		!errors.As(err, &x509.HostnameError{}) &&
+		!errors.As(err, &x509.CertificateInvalidError{})
+}
+
+// retry calls f until it succeeds, fails for good, has been retried retries times or ctx is cancelled,
+// backing off exponentially, with jitter, between attempts; only use it for requests that are safe to
+// send twice
+func (clnt piaClientImpl) retry(ctx context.Context, request string, region string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= clnt.retries || !retryable(err) {
+			return err
+		}
+		wait := backoff(clnt.retryWait, attempt)
+		kv := []interface{}{"request", request, "attempt", attempt + 1, "wait", wait, logging.KeyError, err}
+		if len(region) > 0 {
+			kv = append(kv, logging.KeyRegion, region)
+		}
+		log.Warning("pia request failed, retrying", kv...)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+var (
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+// backoff returns the wait before retrying a request for the attempt+1th time: somewhere between half
+// and all of base doubled attempt times, so clients that failed together don't all retry together
+func backoff(base time.Duration, attempt int) time.Duration {
+	wait := maxRetryWait
+	if attempt < 32 && base<<attempt > 0 && base<<attempt < maxRetryWait {
+		wait = base << attempt
+	}
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return wait/2 + time.Duration(jitter.Int63n(int64(wait/2)+1))
+}
@@ -0,0 +1,134 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package piaclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient/piatest"
+)
+
+const (
+	serverListPath = "/vpninfo/servers/v4"
+	tokenPath      = "/authv3/generateToken"
+	addKeyPath     = "/addKey"
+)
+
+func newRetryingClient(srv *piatest.Server, retries int) PiaClient {
+	return NewWithOptions(piatest.ServerListUrl, Options{
+		Transport: srv.Transport,
+		Timeout:   200 * time.Millisecond,
+		Retries:   retries,
+		RetryWait: time.Millisecond,
+	})
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	srv.Fail(serverListPath, http.StatusServiceUnavailable, http.StatusBadGateway)
+	srv.Fail(tokenPath, http.StatusInternalServerError)
+	srv.Fail(addKeyPath, http.StatusTooManyRequests)
+
+	_, err := newRetryingClient(srv, 2).CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	require.NoError(t, err)
+	require.Equal(t, 3, srv.Hits(serverListPath))
+	require.Equal(t, 2, srv.Hits(tokenPath))
+	require.Equal(t, 2, srv.Hits(addKeyPath))
+}
+
+func TestRetriesStalledServer(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	srv.Fail(tokenPath, 0, 0)
+
+	start := time.Now()
+	_, err := newRetryingClient(srv, 1).CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	var netErr NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, "token fetch", netErr.Op)
+	require.Equal(t, 2, srv.Hits(tokenPath))
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	srv.Fail(addKeyPath, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+	_, err := newRetryingClient(srv, 2).CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	var netErr NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, 3, srv.Hits(addKeyPath))
+}
+
+func TestRetryWaitEndsWhenCancelled(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	srv.Fail(tokenPath, http.StatusBadGateway, http.StatusBadGateway)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pia := NewWithOptions(piatest.ServerListUrl, Options{
+		Transport: srv.Transport,
+		Retries:   2,
+		RetryWait: time.Minute,
+		Context:   ctx,
+	})
+
+	start := time.Now()
+	_, err := pia.CreateTunnel(piatest.Id, piatest.Password, "ca_toronto")
+	var netErr NetworkError
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	require.Equal(t, 1, srv.Hits(tokenPath))
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestNoRetryWhenRejected(t *testing.T) {
+	srv := piatest.NewServer()
+	defer srv.Close()
+	pia := newRetryingClient(srv, 2)
+
+	_, err := pia.CreateTunnel(piatest.Id, "wrong-password", "ca_toronto")
+	require.True(t, errors.As(err, &AuthError{}), "%v", err)
+	require.Equal(t, 1, srv.Hits(tokenPath))
+
+	_, err = pia.CreateTunnelWithToken("not-a-token", "ca_toronto")
+	require.True(t, errors.As(err, &AddKeyError{}), "%v", err)
+	require.Equal(t, 1, srv.Hits(addKeyPath))
+
+	srv.Fail(serverListPath, http.StatusNotFound)
+	_, err = newRetryingClient(srv, 2).GetRegions()
+	require.True(t, errors.As(err, &NetworkError{}), "%v", err)
+	require.Equal(t, 2, srv.Hits(serverListPath))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, maxRetryWait, maxRetryWait} {
+		for i := 0; i < 100; i++ {
+			wait := backoff(time.Second, attempt)
+			require.GreaterOrEqual(t, int64(wait), int64(want/2), "attempt %d", attempt)
+			require.LessOrEqual(t, int64(wait), int64(want), "attempt %d", attempt)
+		}
+	}
+	require.LessOrEqual(t, int64(backoff(time.Second, 100)), int64(maxRetryWait))
+}
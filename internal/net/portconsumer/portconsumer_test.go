@@ -0,0 +1,123 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package portconsumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newQBittorrentServer mimics the qBittorrent web api; port receives the listen port set
+func newQBittorrentServer(t *testing.T, port *int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("username") != "admin" || r.FormValue("password") != "secret" {
+			w.Write([]byte("Fails."))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: "sid123", Path: "/"})
+		w.Write([]byte("Ok."))
+	})
+	mux.HandleFunc("/api/v2/app/setPreferences", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("SID")
+		if err != nil || c.Value != "sid123" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		require.Equal(t, http.MethodPost, r.Method)
+		require.True(t, strings.HasPrefix(r.Header.Get("Referer"), "http://127.0.0.1"))
+		var prefs struct {
+			ListenPort int `json:"listen_port"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(r.FormValue("json")), &prefs))
+		*port = prefs.ListenPort
+	})
+	return httptest.NewServer(mux)
+}
+
+// newTransmissionServer mimics the transmission rpc api; port receives the peer port set
+func newTransmissionServer(t *testing.T, port *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/transmission/rpc", r.URL.Path)
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Transmission-Session-Id") != "abc" {
+			w.Header().Set("X-Transmission-Session-Id", "abc")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		var req struct {
+			Method    string
+			Arguments map[string]int
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "session-set", req.Method)
+		*port = req.Arguments["peer-port"]
+		w.Write([]byte(`{"arguments":{},"result":"success"}`))
+	}))
+}
+
+func TestQBittorrent(t *testing.T) {
+	var port int
+	srv := newQBittorrentServer(t, &port)
+	defer srv.Close()
+	c, err := New("qbittorrent=" + strings.Replace(srv.URL, "http://", "http://admin:secret@", 1))
+	require.NoError(t, err)
+	require.NoError(t, c.SetPort(47047))
+	require.Equal(t, 47047, port)
+	require.NotContains(t, c.Name(), "secret")
+}
+
+func TestQBittorrentBadCredentials(t *testing.T) {
+	var port int
+	srv := newQBittorrentServer(t, &port)
+	defer srv.Close()
+	c, err := New("qbittorrent=" + strings.Replace(srv.URL, "http://", "http://admin:wrong@", 1))
+	require.NoError(t, err)
+	require.Error(t, c.SetPort(47047))
+	require.Equal(t, 0, port)
+}
+
+func TestTransmission(t *testing.T) {
+	var port int
+	srv := newTransmissionServer(t, &port)
+	defer srv.Close()
+	c, err := New("transmission=" + strings.Replace(srv.URL, "http://", "http://admin:secret@", 1))
+	require.NoError(t, err)
+	require.NoError(t, c.SetPort(47047))
+	require.Equal(t, 47047, port)
+
+	c, err = New("transmission=" + srv.URL)
+	require.NoError(t, err)
+	require.Error(t, c.SetPort(47048))
+	require.Equal(t, 47047, port)
+}
+
+func TestNewRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"qbittorrent", "deluge=http://localhost", "transmission=not a url", "qbittorrent=/no/host"} {
+		_, err := New(spec)
+		require.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package portconsumer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)
+type qBittorrent struct {
+	url      *url.URL
+	base     string
+	username string
+	password string
+	http     *resty.Client
+}
+
+func newQBittorrent(u *url.URL) (PortConsumer, error) {
+	pwd, _ := u.User.Password()
+	base := baseUrl(u)
+	return qBittorrent{
+		url:      u,
+		base:     base,
+		username: u.User.Username(),
+		password: pwd,
+		// the web ui rejects requests whose referer doesn't match its own host
+		http: resty.New().SetHeader("Referer", base),
+	}, nil
+}
+
+func (q qBittorrent) Name() string {
+	return fmt.Sprintf("qbittorrent [%s]", redacted(q.url))
+}
+
+func (q qBittorrent) SetPort(port uint16) error {
+	// no credentials is valid when the web ui is configured to skip auth for local clients
+	if len(q.username) > 0 {
+		resp, err := q.http.R().
+			SetFormData(map[string]string{
+				"username": q.username,
+				"password": q.password,
+			}).Post(q.base + "/api/v2/auth/login")
+		if err != nil {
+			return fmt.Errorf("qbittorrent login failed: %w", err)
+		}
+		if resp.StatusCode() != 200 || strings.TrimSpace(resp.String()) != "Ok." {
+			return fmt.Errorf("qbittorrent login failed: %s %s", resp.Status(), resp.String())
+		}
+	}
+	resp, err := q.http.R().
+		SetFormData(map[string]string{
+			"json": fmt.Sprintf(`{"listen_port":%d}`, port),
+		}).Post(q.base + "/api/v2/app/setPreferences")
+	if err != nil {
+		return fmt.Errorf("qbittorrent setPreferences failed: %w", err)
+	}
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("qbittorrent setPreferences failed: %s %s", resp.Status(), resp.String())
+	}
+	log.V(4).Info("listen port set", "consumer", q.Name(), "port", port)
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package portconsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	transmissionRpcPath   = "/transmission/rpc"
+	transmissionSessionId = "X-Transmission-Session-Id"
+)
+
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+type transmission struct {
+	url  *url.URL
+	rpc  string
+	http *resty.Client
+}
+
+func newTransmission(u *url.URL) (PortConsumer, error) {
+	rpc := baseUrl(u)
+	if len(u.Path) == 0 || u.Path == "/" {
+		rpc += transmissionRpcPath
+	}
+	c := resty.New()
+	if pwd, ok := u.User.Password(); ok {
+		c.SetBasicAuth(u.User.Username(), pwd)
+	}
+	return transmission{
+		url:  u,
+		rpc:  rpc,
+		http: c,
+	}, nil
+}
+
+func (t transmission) Name() string {
+	return fmt.Sprintf("transmission [%s]", redacted(t.url))
+}
+
+func (t transmission) SetPort(port uint16) error {
+	req := map[string]interface{}{
+		"method": "session-set",
+		"arguments": map[string]interface{}{
+			"peer-port": port,
+		},
+	}
+	resp, err := t.http.R().SetBody(req).Post(t.rpc)
+	if err == nil && resp.StatusCode() == http.StatusConflict {
+		// csrf protection: the first request is rejected with the session id to use
+		resp, err = t.http.R().
+			SetHeader(transmissionSessionId, resp.Header().Get(transmissionSessionId)).
+			SetBody(req).
+			Post(t.rpc)
+	}
+	if err != nil {
+		return fmt.Errorf("transmission session-set failed: %w", err)
+	}
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("transmission session-set failed: %s", resp.Status())
+	}
+	var result struct {
+		Result string
+	}
+	if err = json.Unmarshal(resp.Body(), &result); err != nil {
+		return fmt.Errorf("json parse of transmission response failed: %w", err)
+	}
+	if result.Result != "success" {
+		return fmt.Errorf("transmission session-set failed: %s", result.Result)
+	}
+	log.V(4).Info("peer port set", "consumer", t.Name(), "port", port)
+	return nil
+}
@@ -0,0 +1,289 @@
+// +build linux
+
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package wgdevice
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	wgMtu      = 1420
+	resolvConf = "/etc/resolv.conf"
+)
+
+// splitDefault covers all of ipv4 without replacing the existing default route, same as wg-quick
+var splitDefault = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// netlinkLink manages wg devices with rtnetlink; dns is set via resolvconf when it's installed
+// and by rewriting resolv.conf otherwise
+type netlinkLink struct{}
+
+func newLink() Link {
+	return netlinkLink{}
+}
+
+func (l netlinkLink) Create(name string) error {
+	return netlink.LinkAdd(&netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{Name: name, MTU: wgMtu},
+		LinkType:  "wireguard",
+	})
+}
+
+func (l netlinkLink) Delete(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func (l netlinkLink) Address(name string) (*net.IPNet, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	current, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil || len(current) == 0 {
+		return nil, err
+	}
+	return current[0].IPNet, nil
+}
+
+// SetAddress makes addr the only ipv4 address of the device
+func (l netlinkLink) SetAddress(name string, addr *net.IPNet) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	current, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, a := range current {
+		if !a.IPNet.IP.Equal(addr.IP) {
+			log.V(4).Info("removing address", "interface", name, "addr", a.IPNet)
+			if err = netlink.AddrDel(link, &a); err != nil {
+				return err
+			}
+		}
+	}
+	return netlink.AddrReplace(link, &netlink.Addr{IPNet: addr})
+}
+
+func (l netlinkLink) Up(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func (l netlinkLink) AddRoutes(name string, endpoint net.IP, dsts []net.IPNet) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	index := link.Attrs().Index
+	gw, err := netlink.RouteGet(endpoint)
+	if err != nil {
+		return fmt.Errorf("no route to %s: %w", endpoint, err)
+	}
+	// the endpoint keeps using the current route; once the tunnel's routes are in place that route is
+	// the tunnel, so a device that's already routed relies on Up having moved the old endpoint's route
+	if len(gw) > 0 && gw[0].LinkIndex != index {
+		host := &netlink.Route{
+			Dst:       &net.IPNet{IP: endpoint, Mask: net.CIDRMask(32, 32)},
+			Gw:        gw[0].Gw,
+			LinkIndex: gw[0].LinkIndex,
+		}
+		log.V(4).Info("adding route", "dst", host.Dst, "gw", host.Gw)
+		if err = netlink.RouteReplace(host); err != nil {
+			return err
+		}
+	}
+	for _, dst := range routeDsts(dsts) {
+		dst := dst
+		log.V(4).Info("adding route", "dst", &dst, "interface", name)
+		if err = netlink.RouteReplace(&netlink.Route{Dst: &dst, LinkIndex: index, Scope: netlink.SCOPE_LINK}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeDsts returns the routes that send dsts through the device; all of ipv4 is split in two
+func routeDsts(dsts []net.IPNet) []net.IPNet {
+	var routes []net.IPNet
+	for _, dst := range dsts {
+		if ones, _ := dst.Mask.Size(); ones > 0 {
+			routes = append(routes, dst)
+			continue
+		}
+		for _, cidr := range splitDefault {
+			_, half, _ := net.ParseCIDR(cidr)
+			routes = append(routes, *half)
+		}
+	}
+	return routes
+}
+
+// DeleteRoutes removes the endpoint route; the others go away with the device
+func (l netlinkLink) DeleteRoutes(name string, endpoint net.IP) error {
+	err := netlink.RouteDel(&netlink.Route{Dst: &net.IPNet{IP: endpoint, Mask: net.CIDRMask(32, 32)}})
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+func (l netlinkLink) MoveEndpointRoute(name string, from net.IP, to net.IP) error {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Dst: &net.IPNet{IP: from, Mask: net.CIDRMask(32, 32)},
+	}, netlink.RT_FILTER_DST)
+	if err != nil || len(routes) == 0 {
+		return err
+	}
+	moved := routes[0]
+	moved.Dst = &net.IPNet{IP: to, Mask: net.CIDRMask(32, 32)}
+	log.V(4).Info("moving route", "from", from, "to", to, "gw", moved.Gw)
+	if err = netlink.RouteReplace(&moved); err != nil {
+		return err
+	}
+	return l.DeleteRoutes(name, from)
+}
+
+func (l netlinkLink) SetDns(name string, servers []string) error {
+	var conf strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", s)
+	}
+	if resolvconf, err := exec.LookPath("resolvconf"); err == nil {
+		cmd := exec.Command(resolvconf, "-a", name, "-m", "0", "-x")
+		cmd.Stdin = strings.NewReader(conf.String())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf failed: %w\n%s", err, string(out))
+		}
+		return nil
+	}
+	backup := resolvConfBackup(name)
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		current, err := ioutil.ReadFile(resolvConf)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(backup, current, 0644); err != nil {
+			return err
+		}
+	}
+	log.V(4).Info("rewriting resolv.conf", "path", resolvConf, "backup", backup)
+	return ioutil.WriteFile(resolvConf, []byte(conf.String()), 0644)
+}
+
+func (l netlinkLink) RestoreDns(name string) error {
+	if resolvconf, err := exec.LookPath("resolvconf"); err == nil {
+		// -f: not an error when no dns was set for the device
+		if out, err := exec.Command(resolvconf, "-d", name, "-f").CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf failed: %w\n%s", err, string(out))
+		}
+		return nil
+	}
+	backup := resolvConfBackup(name)
+	original, err := ioutil.ReadFile(backup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// written in place since resolv.conf is often a symlink
+	if err = ioutil.WriteFile(resolvConf, original, 0644); err != nil {
+		return err
+	}
+	return os.Remove(backup)
+}
+
+func resolvConfBackup(name string) string {
+	return fmt.Sprintf("%s.%s.piawgcli", resolvConf, name)
+}
+
+// killSwitchChain is the iptables chain holding the kill switch of the named device; OUTPUT jumps to it
+func killSwitchChain(name string) string {
+	return "piawgcli-" + name
+}
+
+func iptables(args ...string) error {
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s failed: %w\n%s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+func (l netlinkLink) KillSwitch(name string) bool {
+	return exec.Command("iptables", "-n", "-L", killSwitchChain(name)).Run() == nil
+}
+
+// SetKillSwitch fills the device's chain with: allow what goes out the device, to the endpoint or to
+// this host and reject the rest; an existing chain only has its endpoint rule replaced, so there's no
+// moment without the kill switch
+func (l netlinkLink) SetKillSwitch(name string, endpoint net.IP) error {
+	chain := killSwitchChain(name)
+	dst := (&net.IPNet{IP: endpoint, Mask: net.CIDRMask(32, 32)}).String()
+	if l.KillSwitch(name) {
+		log.V(4).Info("moving kill switch", "interface", name, "endpoint", dst)
+		return iptables("-R", chain, "2", "-d", dst, "-j", "RETURN")
+	}
+	log.V(4).Info("adding kill switch", "interface", name, "endpoint", dst)
+	rules := [][]string{
+		{"-N", chain},
+		{"-A", chain, "-o", name, "-j", "RETURN"},
+		{"-A", chain, "-d", dst, "-j", "RETURN"},
+		{"-A", chain, "-m", "addrtype", "--dst-type", "LOCAL", "-j", "RETURN"},
+		{"-A", chain, "-j", "REJECT"},
+		{"-I", "OUTPUT", "-j", chain},
+	}
+	for _, rule := range rules {
+		if err := iptables(rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l netlinkLink) DeleteKillSwitch(name string) error {
+	if !l.KillSwitch(name) {
+		return nil
+	}
+	chain := killSwitchChain(name)
+	log.V(4).Info("removing kill switch", "interface", name)
+	for _, rule := range [][]string{{"-D", "OUTPUT", "-j", chain}, {"-F", chain}, {"-X", chain}} {
+		if err := iptables(rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
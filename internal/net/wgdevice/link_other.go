@@ -0,0 +1,48 @@
+// +build !linux
+
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package wgdevice
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+var errUnsupported = fmt.Errorf("managing wg devices is not supported on %s; use create-config and the platform's wg tools instead", runtime.GOOS)
+
+type unsupportedLink struct{}
+
+func newLink() Link {
+	return unsupportedLink{}
+}
+
+func (l unsupportedLink) Create(string) error                            { return errUnsupported }
+func (l unsupportedLink) Delete(string) error                            { return errUnsupported }
+func (l unsupportedLink) Address(string) (*net.IPNet, error)             { return nil, errUnsupported }
+func (l unsupportedLink) MoveEndpointRoute(string, net.IP, net.IP) error { return errUnsupported }
+func (l unsupportedLink) SetAddress(string, *net.IPNet) error            { return errUnsupported }
+func (l unsupportedLink) Up(string) error                                { return errUnsupported }
+func (l unsupportedLink) AddRoutes(string, net.IP, []net.IPNet) error    { return errUnsupported }
+func (l unsupportedLink) DeleteRoutes(string, net.IP) error              { return errUnsupported }
+func (l unsupportedLink) SetDns(string, []string) error                  { return errUnsupported }
+func (l unsupportedLink) RestoreDns(string) error                        { return errUnsupported }
+func (l unsupportedLink) KillSwitch(string) bool                         { return false }
+func (l unsupportedLink) SetKillSwitch(string, net.IP) error             { return errUnsupported }
+func (l unsupportedLink) DeleteKillSwitch(string) error                  { return errUnsupported }
@@ -0,0 +1,375 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package wgdevice
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var log = logging.Component("wgdevice")
+
+// PersistentKeepalive matches the keep alive used in the configs written by create-config
+const PersistentKeepalive = 25 * time.Second
+
+// WgClient is the part of wgctrl.Client used to configure devices
+type WgClient interface {
+	Devices() ([]*wgtypes.Device, error)
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+// Link manages the OS side of a wg device: the network interface itself, its address, routes and dns
+type Link interface {
+	Create(name string) error
+	Delete(name string) error
+	// Address returns the device's ipv4 address, nil when it has none
+	Address(name string) (*net.IPNet, error)
+	SetAddress(name string, addr *net.IPNet) error
+	Up(name string) error
+	// AddRoutes sends the traffic to dsts through the device, except traffic to the wg server endpoint
+	AddRoutes(name string, endpoint net.IP, dsts []net.IPNet) error
+	DeleteRoutes(name string, endpoint net.IP) error
+	// MoveEndpointRoute points the route added for one endpoint by AddRoutes at another; it's
+	// a no op when no such route exists
+	MoveEndpointRoute(name string, from net.IP, to net.IP) error
+	SetDns(name string, servers []string) error
+	RestoreDns(name string) error
+	// KillSwitch tells whether the device has a kill switch
+	KillSwitch(name string) bool
+	// SetKillSwitch rejects all traffic that doesn't go through the device, except traffic to the wg
+	// server endpoint; it replaces the endpoint of an existing kill switch
+	SetKillSwitch(name string, endpoint net.IP) error
+	DeleteKillSwitch(name string) error
+}
+
+// Options control what, beyond the wg device itself, is configured when bringing a tunnel up
+type Options struct {
+	Routes bool // route the allowed ips through the tunnel; the server virtual ip always is
+	Dns    bool // use the PIA dns servers
+	// AllowedIps is what's sent through the tunnel, all of ipv4 when empty; nil keeps what an existing
+	// device already sends through it
+	AllowedIps []net.IPNet
+	// KillSwitch rejects traffic that doesn't go through the tunnel; a device's kill switch is kept,
+	// with its endpoint updated, until the device is taken down
+	KillSwitch bool
+}
+
+// Change describes a setting of a device that was modified by Refresh
+type Change struct {
+	Setting string
+	From    string
+	To      string
+}
+
+// Manager applies PIA tunnels directly to kernel wg devices
+type Manager struct {
+	wg   WgClient
+	link Link
+}
+
+func New() (*Manager, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open wg control client: %w", err)
+	}
+	return NewWithClients(wg, newLink()), nil
+}
+
+func NewWithClients(wg WgClient, link Link) *Manager {
+	return &Manager{
+		wg:   wg,
+		link: link,
+	}
+}
+
+func (m *Manager) Close() error {
+	return m.wg.Close()
+}
+
+// Up configures the named device, creating it when needed, as the given PIA tunnel
+func (m *Manager) Up(name string, iface piaclient.PiaInterface, opts Options) error {
+	dev, devErr := m.wg.Device(name)
+	allowed := opts.AllowedIps
+	if devErr == nil && allowed == nil && len(dev.Peers) > 0 {
+		allowed = dev.Peers[0].AllowedIPs
+	}
+	cfg, err := DeviceConfig(iface, TunnelAllowedIps(iface, allowed, opts.Dns))
+	if err != nil {
+		return err
+	}
+	addr, err := ClientAddress(iface)
+	if err != nil {
+		return err
+	}
+	created := false
+	if devErr != nil {
+		if !os.IsNotExist(devErr) {
+			return fmt.Errorf("unable to read device %s: %w", name, devErr)
+		}
+		log.V(1).Info("creating wg device", "interface", name)
+		if err = m.link.Create(name); err != nil {
+			return fmt.Errorf("unable to create device %s: %w", name, err)
+		}
+		created = true
+	} else if len(dev.Peers) > 0 && dev.Peers[0].Endpoint != nil {
+		// with the tunnel's routes in place the new endpoint would otherwise be routed into the tunnel
+		if old := dev.Peers[0].Endpoint.IP; !old.Equal(cfg.Peers[0].Endpoint.IP) {
+			if err = m.link.MoveEndpointRoute(name, old, cfg.Peers[0].Endpoint.IP); err != nil {
+				return fmt.Errorf("unable to move route to %s: %w", old, err)
+			}
+		}
+	}
+	err = m.configure(name, iface, cfg, addr, opts)
+	if err != nil && created {
+		log.V(1).Info("removing wg device after failed setup", "interface", name)
+		if delErr := m.link.Delete(name); delErr != nil {
+			log.Error(delErr, "unable to remove device", "interface", name)
+		}
+	}
+	return err
+}
+
+func (m *Manager) configure(name string, iface piaclient.PiaInterface, cfg wgtypes.Config, addr *net.IPNet, opts Options) error {
+	if err := m.wg.ConfigureDevice(name, cfg); err != nil {
+		return fmt.Errorf("unable to configure device %s: %w", name, err)
+	}
+	if err := m.link.SetAddress(name, addr); err != nil {
+		return fmt.Errorf("unable to set address of %s: %w", name, err)
+	}
+	if err := m.link.Up(name); err != nil {
+		return fmt.Errorf("unable to bring up %s: %w", name, err)
+	}
+	routes := cfg.Peers[0].AllowedIPs
+	if !opts.Routes {
+		// session checks and port forwarding talk to the server's virtual ip, which only answers
+		// through the tunnel, so it's routed there either way
+		routes = nil
+		if vip := net.ParseIP(iface.ServerVirtualIp).To4(); vip != nil {
+			routes = []net.IPNet{{IP: vip, Mask: net.CIDRMask(32, 32)}}
+		}
+	}
+	if len(routes) > 0 {
+		if err := m.link.AddRoutes(name, cfg.Peers[0].Endpoint.IP, routes); err != nil {
+			return fmt.Errorf("unable to add routes for %s: %w", name, err)
+		}
+	}
+	if opts.KillSwitch || m.link.KillSwitch(name) {
+		if err := m.link.SetKillSwitch(name, cfg.Peers[0].Endpoint.IP); err != nil {
+			return fmt.Errorf("unable to set the kill switch of %s: %w", name, err)
+		}
+	}
+	if opts.Dns && len(iface.DnsServers) > 0 {
+		if err := m.link.SetDns(name, iface.DnsServers); err != nil {
+			return fmt.Errorf("unable to set dns servers for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Device returns the current wg state of the named device
+func (m *Manager) Device(name string) (*wgtypes.Device, error) {
+	dev, err := m.wg.Device(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read device %s: %w", name, err)
+	}
+	return dev, nil
+}
+
+// Devices returns the current wg state of every device
+func (m *Manager) Devices() ([]*wgtypes.Device, error) {
+	devs, err := m.wg.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list wg devices: %w", err)
+	}
+	return devs, nil
+}
+
+// Refresh swaps the peer and address of a running device for those of the given tunnel
+// without taking the device down, so existing connections survive; the device keeps sending
+// what it already sends through the tunnel
+func (m *Manager) Refresh(name string, iface piaclient.PiaInterface) ([]Change, error) {
+	dev, err := m.Device(name)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []net.IPNet
+	if len(dev.Peers) > 0 {
+		allowed = dev.Peers[0].AllowedIPs
+	}
+	cfg, err := DeviceConfig(iface, TunnelAllowedIps(iface, allowed, false))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := ClientAddress(iface)
+	if err != nil {
+		return nil, err
+	}
+	oldAddr, err := m.link.Address(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read address of %s: %w", name, err)
+	}
+	peer := cfg.Peers[0]
+	var changes []Change
+	var oldEndpoint *net.UDPAddr
+	if len(dev.Peers) > 0 {
+		oldEndpoint = dev.Peers[0].Endpoint
+		if dev.Peers[0].PublicKey != peer.PublicKey {
+			changes = append(changes, Change{"peer", dev.Peers[0].PublicKey.String(), peer.PublicKey.String()})
+		}
+	} else {
+		changes = append(changes, Change{"peer", "", peer.PublicKey.String()})
+	}
+	var from string
+	if oldEndpoint != nil {
+		from = oldEndpoint.String()
+	}
+	if from != peer.Endpoint.String() {
+		changes = append(changes, Change{"endpoint", from, peer.Endpoint.String()})
+	}
+	from = ""
+	if oldAddr != nil {
+		from = oldAddr.String()
+	}
+	if from != addr.String() {
+		changes = append(changes, Change{"address", from, addr.String()})
+	}
+	// move the endpoint route first so handshakes with the new endpoint don't loop into the tunnel
+	if oldEndpoint != nil && !oldEndpoint.IP.Equal(peer.Endpoint.IP) {
+		if err = m.link.MoveEndpointRoute(name, oldEndpoint.IP, peer.Endpoint.IP); err != nil {
+			return nil, fmt.Errorf("unable to move route to %s: %w", oldEndpoint.IP, err)
+		}
+	}
+	if m.link.KillSwitch(name) {
+		if err = m.link.SetKillSwitch(name, peer.Endpoint.IP); err != nil {
+			return nil, fmt.Errorf("unable to set the kill switch of %s: %w", name, err)
+		}
+	}
+	// the private key is unchanged so wg keeps the device's other state
+	cfg.PrivateKey = nil
+	if err = m.wg.ConfigureDevice(name, cfg); err != nil {
+		return nil, fmt.Errorf("unable to configure device %s: %w", name, err)
+	}
+	if err = m.link.SetAddress(name, addr); err != nil {
+		return nil, fmt.Errorf("unable to set address of %s: %w", name, err)
+	}
+	return changes, nil
+}
+
+// Down removes the named device along with the routes and dns added by Up
+func (m *Manager) Down(name string) error {
+	dev, err := m.wg.Device(name)
+	if err != nil {
+		return fmt.Errorf("unable to read device %s: %w", name, err)
+	}
+	for _, p := range dev.Peers {
+		if p.Endpoint != nil {
+			if err = m.link.DeleteRoutes(name, p.Endpoint.IP); err != nil {
+				log.Warning("unable to remove route", "dst", p.Endpoint.IP, logging.KeyError, err)
+			}
+		}
+	}
+	if err = m.link.RestoreDns(name); err != nil {
+		log.Warning("unable to restore dns settings", "interface", name, logging.KeyError, err)
+	}
+	if err = m.link.DeleteKillSwitch(name); err != nil {
+		log.Warning("unable to remove the kill switch", "interface", name, logging.KeyError, err)
+	}
+	if err = m.link.Delete(name); err != nil {
+		return fmt.Errorf("unable to remove device %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeviceConfig returns the wg configuration of the given PIA tunnel, sending the allowed ips through it;
+// it replaces any existing peers
+func DeviceConfig(iface piaclient.PiaInterface, allowed []net.IPNet) (wgtypes.Config, error) {
+	privKey, err := wgtypes.ParseKey(iface.ClientPrivateKey)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("invalid client private key: %w", err)
+	}
+	serverKey, err := wgtypes.ParseKey(iface.ServerPublicKey)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("invalid server public key: %w", err)
+	}
+	endpoint := net.ParseIP(iface.ServerEndpoint)
+	if endpoint == nil {
+		return wgtypes.Config{}, fmt.Errorf("invalid server endpoint: %s", iface.ServerEndpoint)
+	}
+	keepalive := PersistentKeepalive
+	return wgtypes.Config{
+		PrivateKey:   &privKey,
+		ReplacePeers: true,
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   serverKey,
+			Endpoint:                    &net.UDPAddr{IP: endpoint, Port: int(iface.ServerPort)},
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  allowed,
+		}},
+	}, nil
+}
+
+// ClientAddress returns the address assigned to the client end of the given PIA tunnel
+func ClientAddress(iface piaclient.PiaInterface) (*net.IPNet, error) {
+	ip := net.ParseIP(iface.ClientIp).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client ip: %s", iface.ClientIp)
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+}
+
+// TunnelAllowedIps returns the cidrs to send through the given PIA tunnel: the given cidrs, or all
+// of ipv4 when there are none, plus the tunnel's server virtual ip and, with dns, the PIA dns servers
+// when the cidrs don't already cover them, since the port forwarding api and the daemon's probes go
+// to the virtual ip
+func TunnelAllowedIps(iface piaclient.PiaInterface, cidrs []net.IPNet, dns bool) []net.IPNet {
+	if len(cidrs) == 0 {
+		_, all, _ := net.ParseCIDR("0.0.0.0/0")
+		return []net.IPNet{*all}
+	}
+	allowed := append([]net.IPNet(nil), cidrs...)
+	hosts := []string{iface.ServerVirtualIp}
+	if dns {
+		hosts = append(hosts, iface.DnsServers...)
+	}
+	for _, h := range hosts {
+		ip := net.ParseIP(h).To4()
+		if ip != nil && !containsIp(allowed, ip) {
+			allowed = append(allowed, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	return allowed
+}
+
+func containsIp(cidrs []net.IPNet, ip net.IP) bool {
+	for _, c := range cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package wgdevice
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWg keeps devices in memory, applying configs the way the kernel would
+type fakeWg struct {
+	devices map[string]*wgtypes.Device
+}
+
+func newFakeWg() *fakeWg {
+	return &fakeWg{devices: map[string]*wgtypes.Device{}}
+}
+
+func (f *fakeWg) Devices() ([]*wgtypes.Device, error) {
+	var devs []*wgtypes.Device
+	for _, d := range f.devices {
+		devs = append(devs, d)
+	}
+	return devs, nil
+}
+
+func (f *fakeWg) Device(name string) (*wgtypes.Device, error) {
+	d, ok := f.devices[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return d, nil
+}
+
+func (f *fakeWg) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	d, ok := f.devices[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if cfg.PrivateKey != nil {
+		d.PrivateKey = *cfg.PrivateKey
+		d.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ReplacePeers {
+		d.Peers = nil
+	}
+	for _, p := range cfg.Peers {
+		d.Peers = append(d.Peers, wgtypes.Peer{
+			PublicKey:                   p.PublicKey,
+			Endpoint:                    p.Endpoint,
+			PersistentKeepaliveInterval: *p.PersistentKeepaliveInterval,
+			AllowedIPs:                  p.AllowedIPs,
+		})
+	}
+	return nil
+}
+
+func (f *fakeWg) Close() error {
+	return nil
+}
+
+// fakeLink records the calls made to it; the named call, if any, fails
+type fakeLink struct {
+	wg         *fakeWg
+	calls      []string
+	fail       string
+	addr       *net.IPNet
+	routes     []net.IPNet
+	killSwitch net.IP
+}
+
+func (l *fakeLink) record(call string) error {
+	l.calls = append(l.calls, call)
+	if call == l.fail {
+		return fmt.Errorf("%s failed", call)
+	}
+	return nil
+}
+
+func (l *fakeLink) Create(name string) error {
+	l.wg.devices[name] = &wgtypes.Device{Name: name}
+	return l.record("create")
+}
+
+func (l *fakeLink) Delete(name string) error {
+	delete(l.wg.devices, name)
+	return l.record("delete")
+}
+
+func (l *fakeLink) Address(name string) (*net.IPNet, error) {
+	return l.addr, nil
+}
+
+func (l *fakeLink) SetAddress(name string, addr *net.IPNet) error {
+	l.addr = addr
+	return l.record("address " + addr.String())
+}
+
+func (l *fakeLink) Up(name string) error {
+	return l.record("up")
+}
+
+func (l *fakeLink) AddRoutes(name string, endpoint net.IP, dsts []net.IPNet) error {
+	l.routes = dsts
+	return l.record("routes " + endpoint.String())
+}
+
+func (l *fakeLink) DeleteRoutes(name string, endpoint net.IP) error {
+	return l.record("delroutes " + endpoint.String())
+}
+
+func (l *fakeLink) MoveEndpointRoute(name string, from net.IP, to net.IP) error {
+	return l.record(fmt.Sprintf("moveroute %s %s", from, to))
+}
+
+func (l *fakeLink) SetDns(name string, servers []string) error {
+	return l.record(fmt.Sprint("dns ", servers))
+}
+
+func (l *fakeLink) RestoreDns(name string) error {
+	return l.record("restoredns")
+}
+
+func (l *fakeLink) KillSwitch(name string) bool {
+	return l.killSwitch != nil
+}
+
+func (l *fakeLink) SetKillSwitch(name string, endpoint net.IP) error {
+	l.killSwitch = endpoint
+	return l.record("killswitch " + endpoint.String())
+}
+
+func (l *fakeLink) DeleteKillSwitch(name string) error {
+	l.killSwitch = nil
+	return l.record("delkillswitch")
+}
+
+func testInterface(t *testing.T) piaclient.PiaInterface {
+	clientKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return piaclient.PiaInterface{
+		ServerPublicKey:  serverKey.PublicKey().String(),
+		ServerPort:       1337,
+		ServerEndpoint:   "192.0.2.1",
+		ServerVirtualIp:  "10.1.0.1",
+		ClientIp:         "10.1.2.3",
+		ClientPrivateKey: clientKey.String(),
+		DnsServers:       []string{"10.0.0.243"},
+	}
+}
+
+func TestUpCreatesDevice(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	iface := testInterface(t)
+	require.NoError(t, mgr.Up("pia", iface, Options{Routes: true, Dns: true}))
+	require.Equal(t, []string{"create", "address 10.1.2.3/32", "up", "routes 192.0.2.1", "dns [10.0.0.243]"}, link.calls)
+	dev := wg.devices["pia"]
+	require.Equal(t, iface.ClientPrivateKey, dev.PrivateKey.String())
+	require.Len(t, dev.Peers, 1)
+	require.Equal(t, iface.ServerPublicKey, dev.Peers[0].PublicKey.String())
+	require.Equal(t, "192.0.2.1:1337", dev.Peers[0].Endpoint.String())
+	require.Equal(t, PersistentKeepalive, dev.Peers[0].PersistentKeepaliveInterval)
+	require.Equal(t, "0.0.0.0/0", dev.Peers[0].AllowedIPs[0].String())
+}
+
+func TestUpReconfiguresExistingDevice(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	require.NoError(t, mgr.Up("pia", testInterface(t), Options{}))
+	link.calls = nil
+	iface := testInterface(t)
+	iface.ServerEndpoint = "192.0.2.2"
+	require.NoError(t, mgr.Up("pia", iface, Options{Routes: true}))
+	require.Equal(t, []string{"moveroute 192.0.2.1 192.0.2.2", "address 10.1.2.3/32", "up", "routes 192.0.2.2"}, link.calls)
+	require.Len(t, wg.devices["pia"].Peers, 1)
+	require.Equal(t, iface.ServerPublicKey, wg.devices["pia"].Peers[0].PublicKey.String())
+}
+
+func TestUpWithoutRoutes(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	require.NoError(t, mgr.Up("pia", testInterface(t), Options{}))
+	// only the virtual ip goes through the tunnel, so the daemon's probes and port forwarding still work
+	require.Equal(t, []string{"create", "address 10.1.2.3/32", "up", "routes 192.0.2.1"}, link.calls)
+	require.Equal(t, []string{"10.1.0.1/32"}, cidrStrings(link.routes))
+	require.Equal(t, "0.0.0.0/0", wg.devices["pia"].Peers[0].AllowedIPs[0].String())
+}
+
+func TestUpRemovesDeviceItCreatedOnFailure(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg, fail: "up"}
+	mgr := NewWithClients(wg, link)
+	require.Error(t, mgr.Up("pia", testInterface(t), Options{}))
+	require.Equal(t, "delete", link.calls[len(link.calls)-1])
+	require.NotContains(t, wg.devices, "pia")
+}
+
+func TestUpInvalidInterface(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	iface := testInterface(t)
+	iface.ServerPublicKey = "garbage"
+	require.Error(t, NewWithClients(wg, link).Up("pia", iface, Options{}))
+	require.Empty(t, link.calls)
+}
+
+func TestDown(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	require.NoError(t, mgr.Up("pia", testInterface(t), Options{Routes: true, Dns: true}))
+	link.calls = nil
+	require.NoError(t, mgr.Down("pia"))
+	require.Equal(t, []string{"delroutes 192.0.2.1", "restoredns", "delkillswitch", "delete"}, link.calls)
+	require.Error(t, mgr.Down("pia"))
+}
+
+func TestRefreshSwapsPeer(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	old := testInterface(t)
+	require.NoError(t, mgr.Up("pia", old, Options{Routes: true}))
+	link.calls = nil
+	refreshed := testInterface(t)
+	refreshed.ClientPrivateKey = old.ClientPrivateKey
+	refreshed.ServerEndpoint = "192.0.2.2"
+	refreshed.ClientIp = "10.1.2.4"
+	changes, err := mgr.Refresh("pia", refreshed)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{"peer", old.ServerPublicKey, refreshed.ServerPublicKey},
+		{"endpoint", "192.0.2.1:1337", "192.0.2.2:1337"},
+		{"address", "10.1.2.3/32", "10.1.2.4/32"},
+	}, changes)
+	require.Equal(t, []string{"moveroute 192.0.2.1 192.0.2.2", "address 10.1.2.4/32"}, link.calls)
+	dev := wg.devices["pia"]
+	require.Equal(t, old.ClientPrivateKey, dev.PrivateKey.String())
+	require.Len(t, dev.Peers, 1)
+	require.Equal(t, refreshed.ServerPublicKey, dev.Peers[0].PublicKey.String())
+}
+
+func TestRefreshNoChanges(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	iface := testInterface(t)
+	require.NoError(t, mgr.Up("pia", iface, Options{Routes: true}))
+	link.calls = nil
+	changes, err := mgr.Refresh("pia", iface)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	require.NotContains(t, link.calls, "moveroute 192.0.2.1 192.0.2.1")
+}
+
+func TestUpSplitTunnel(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	_, lan, _ := net.ParseCIDR("198.51.100.0/24")
+	require.NoError(t, mgr.Up("pia", testInterface(t), Options{Routes: true, Dns: true, AllowedIps: []net.IPNet{*lan}}))
+	// the virtual ip and dns server are added so port forwarding, probes and dns keep working
+	want := []string{"198.51.100.0/24", "10.1.0.1/32", "10.0.0.243/32"}
+	require.Equal(t, want, cidrStrings(wg.devices["pia"].Peers[0].AllowedIPs))
+	require.Equal(t, want, cidrStrings(link.routes))
+
+	// nil keeps what the device already sends through the tunnel, i.e. for rotations
+	iface := testInterface(t)
+	iface.ServerVirtualIp = "10.1.0.2"
+	require.NoError(t, mgr.Up("pia", iface, Options{Routes: true}))
+	require.Equal(t, []string{"198.51.100.0/24", "10.1.0.1/32", "10.0.0.243/32", "10.1.0.2/32"}, cidrStrings(wg.devices["pia"].Peers[0].AllowedIPs))
+}
+
+func TestUpKillSwitch(t *testing.T) {
+	wg := newFakeWg()
+	link := &fakeLink{wg: wg}
+	mgr := NewWithClients(wg, link)
+	require.NoError(t, mgr.Up("pia", testInterface(t), Options{Routes: true, KillSwitch: true}))
+	require.Equal(t, []string{"create", "address 10.1.2.3/32", "up", "routes 192.0.2.1", "killswitch 192.0.2.1"}, link.calls)
+
+	// the kill switch follows the endpoint even when it isn't asked for again
+	iface := testInterface(t)
+	iface.ServerEndpoint = "192.0.2.2"
+	require.NoError(t, mgr.Up("pia", iface, Options{Routes: true}))
+	require.Equal(t, "192.0.2.2", link.killSwitch.String())
+
+	refreshed := testInterface(t)
+	refreshed.ClientPrivateKey = iface.ClientPrivateKey
+	refreshed.ServerEndpoint = "192.0.2.3"
+	_, err := mgr.Refresh("pia", refreshed)
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.3", link.killSwitch.String())
+
+	require.NoError(t, mgr.Down("pia"))
+	require.Nil(t, link.killSwitch)
+}
+
+func TestTunnelAllowedIps(t *testing.T) {
+	iface := testInterface(t)
+	require.Equal(t, []string{"0.0.0.0/0"}, cidrStrings(TunnelAllowedIps(iface, nil, true)))
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	require.Equal(t, []string{"10.0.0.0/8"}, cidrStrings(TunnelAllowedIps(iface, []net.IPNet{*private}, true)))
+	_, lan, _ := net.ParseCIDR("198.51.100.0/24")
+	require.Equal(t, []string{"198.51.100.0/24", "10.1.0.1/32"}, cidrStrings(TunnelAllowedIps(iface, []net.IPNet{*lan}, false)))
+}
+
+func cidrStrings(cidrs []net.IPNet) []string {
+	var s []string
+	for _, c := range cidrs {
+		s = append(s, c.String())
+	}
+	return s
+}
+
+func TestRefreshMissingDevice(t *testing.T) {
+	wg := newFakeWg()
+	_, err := NewWithClients(wg, &fakeLink{wg: wg}).Refresh("pia", testInterface(t))
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rotation
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is one rotation attempt; private keys are never recorded
+type Record struct {
+	Time            time.Time
+	Region          string
+	Target          string
+	ServerCn        string `json:",omitempty"`
+	ServerEndpoint  string `json:",omitempty"`
+	ClientPublicKey string `json:",omitempty"`
+	ClientIp        string `json:",omitempty"`
+	Err             string `json:",omitempty"`
+}
+
+// History is an append only file of rotation records, one json object per line
+type History struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewHistory(path string) *History {
+	return &History{path: path}
+}
+
+func (h *History) Append(rec Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Records returns every recorded rotation, oldest first
+func (h *History) Records() ([]Record, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
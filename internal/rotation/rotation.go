@@ -0,0 +1,127 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+var log = logging.Component("rotation")
+
+// ParseSchedule parses a standard 5 field cron spec, or a descriptor such as @daily or @every 6h
+func ParseSchedule(spec string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+	return schedule, nil
+}
+
+// Config describes what is rotated, when and how
+type Config struct {
+	PiaId       string
+	PiaPassword string
+	Schedule    cron.Schedule
+	Region      func() string                            // region to register the next key with
+	Apply       func(iface piaclient.PiaInterface) error // swaps the new tunnel onto the interface or config file
+	Target      string                                   // what Apply updates, for the history
+	History     *History                                 // optional
+}
+
+// Rotator registers a new key pair with PIA on a schedule and applies the new tunnel
+type Rotator struct {
+	cfg  Config
+	pia  piaclient.PiaClient
+	now  func() time.Time
+	lock sync.Mutex // held for a whole rotation so scheduled and requested rotations don't interleave
+}
+
+func New(cfg Config, pia piaclient.PiaClient) *Rotator {
+	return &Rotator{
+		cfg: cfg,
+		pia: pia,
+		now: time.Now,
+	}
+}
+
+// Run rotates on the schedule until ctx is cancelled; failed rotations are logged, recorded
+// and retried at the next scheduled time
+func (r *Rotator) Run(ctx context.Context) error {
+	for {
+		next := r.cfg.Schedule.Next(r.now())
+		log.V(1).Info("next rotation", "at", next.Format(time.RFC3339))
+		timer := time.NewTimer(next.Sub(r.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if _, err := r.Rotate(); err != nil {
+			log.Error(err, "rotation failed")
+		}
+	}
+}
+
+// Rotate registers a new key pair and applies it; every attempt is recorded in the history
+func (r *Rotator) Rotate() (Record, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	region := r.cfg.Region()
+	rec := Record{Time: r.now(), Region: region, Target: r.cfg.Target}
+	log.V(1).Info("rotating to a new key", "target", r.cfg.Target, logging.KeyRegion, region)
+	iface, err := r.pia.CreateTunnel(r.cfg.PiaId, r.cfg.PiaPassword, region)
+	if err == nil {
+		rec.ServerCn = iface.ServerCn
+		rec.ServerEndpoint = iface.ServerEndpoint
+		rec.ClientPublicKey = iface.ClientPublicKey
+		rec.ClientIp = iface.ClientIp
+		err = r.cfg.Apply(iface)
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	} else {
+		log.Info("rotated", "target", r.cfg.Target, logging.KeyRegion, region, "endpoint", iface.ServerEndpoint, "publicKey", iface.ClientPublicKey)
+	}
+	if r.cfg.History != nil {
+		if histErr := r.cfg.History.Append(rec); histErr != nil {
+			log.Error(histErr, "unable to record rotation")
+		}
+	}
+	return rec, err
+}
+
+// Cycle returns a Region func that steps through the given regions in turn, one per rotation
+func Cycle(regions []string) func() string {
+	var lock sync.Mutex
+	next := 0
+	return func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		r := regions[next%len(regions)]
+		next++
+		return r
+	}
+}
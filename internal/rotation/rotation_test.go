@@ -0,0 +1,181 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package rotation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ddb_db/piawgcli/internal/net/piaclient"
+)
+
+type fakePia struct {
+	piaclient.PiaClient
+	lock sync.Mutex
+	keys int
+	down map[string]bool
+}
+
+func (f *fakePia) CreateTunnel(id string, pwd string, regionId string) (piaclient.PiaInterface, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down[regionId] {
+		return piaclient.PiaInterface{}, errors.New("addKey failed")
+	}
+	f.keys++
+	return piaclient.PiaInterface{
+		ServerCn:         regionId + "401",
+		ServerEndpoint:   "192.0.2.1",
+		ClientIp:         "10.1.2.3",
+		ClientPublicKey:  fmt.Sprintf("pub%d", f.keys),
+		ClientPrivateKey: fmt.Sprintf("priv%d", f.keys),
+		PiaRegion:        piaclient.PiaRegion{Id: regionId},
+	}, nil
+}
+
+// soon is a schedule that's always due a few ms from now
+type soon struct{}
+
+func (soon) Next(t time.Time) time.Time {
+	return t.Add(5 * time.Millisecond)
+}
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("0 */6 * * *")
+	require.NoError(t, err)
+	from := time.Date(2023, 1, 1, 1, 30, 0, 0, time.Local)
+	require.Equal(t, time.Date(2023, 1, 1, 6, 0, 0, 0, time.Local), s.Next(from))
+	_, err = ParseSchedule("@every 12h")
+	require.NoError(t, err)
+	_, err = ParseSchedule("every day")
+	require.Error(t, err)
+}
+
+func TestRotateRecordsHistory(t *testing.T) {
+	pia := &fakePia{down: map[string]bool{"ca_montreal": true}}
+	history := NewHistory(filepath.Join(t.TempDir(), "history", "rotations.jsonl"))
+	var applied []piaclient.PiaInterface
+	r := New(Config{
+		Region: Cycle([]string{"ca_toronto", "ca_montreal"}),
+		Apply: func(iface piaclient.PiaInterface) error {
+			applied = append(applied, iface)
+			return nil
+		},
+		Target:  "pia",
+		History: history,
+	}, pia)
+
+	rec, err := r.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, "ca_toronto", rec.Region)
+	require.Equal(t, "pub1", rec.ClientPublicKey)
+	_, err = r.Rotate()
+	require.Error(t, err)
+	require.Len(t, applied, 1)
+
+	records, err := history.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "ca_toronto401", records[0].ServerCn)
+	require.Empty(t, records[0].Err)
+	require.Equal(t, "ca_montreal", records[1].Region)
+	require.Equal(t, "addKey failed", records[1].Err)
+}
+
+func TestRotateApplyFailure(t *testing.T) {
+	r := New(Config{
+		Region: func() string { return "ca_toronto" },
+		Apply: func(piaclient.PiaInterface) error {
+			return errors.New("device busy")
+		},
+	}, &fakePia{})
+	rec, err := r.Rotate()
+	require.Error(t, err)
+	require.Equal(t, "device busy", rec.Err)
+}
+
+func TestConcurrentRotationsTakeTurns(t *testing.T) {
+	var lock sync.Mutex
+	applying := 0
+	overlapped := false
+	var regions []string
+	r := New(Config{
+		Region: Cycle([]string{"ca_toronto", "ca_montreal"}),
+		Apply: func(iface piaclient.PiaInterface) error {
+			lock.Lock()
+			applying++
+			overlapped = overlapped || applying > 1
+			regions = append(regions, iface.PiaRegion.Id)
+			lock.Unlock()
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			applying--
+			lock.Unlock()
+			return nil
+		},
+	}, &fakePia{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Rotate()
+		}()
+	}
+	wg.Wait()
+	require.False(t, overlapped)
+	require.ElementsMatch(t, []string{"ca_toronto", "ca_montreal", "ca_toronto", "ca_montreal", "ca_toronto", "ca_montreal", "ca_toronto", "ca_montreal"}, regions)
+}
+
+func TestRunRotatesOnSchedule(t *testing.T) {
+	pia := &fakePia{}
+	ctx, cancel := context.WithCancel(context.Background())
+	rotations := 0
+	r := New(Config{
+		Schedule: soon{},
+		Region:   func() string { return "ca_toronto" },
+		Apply: func(piaclient.PiaInterface) error {
+			rotations++
+			if rotations == 3 {
+				cancel()
+			}
+			return nil
+		},
+	}, pia)
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotator did not stop")
+	}
+	require.Equal(t, 3, rotations)
+}
+
+func TestHistoryMissingFile(t *testing.T) {
+	records, err := NewHistory(filepath.Join(t.TempDir(), "none.jsonl")).Records()
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
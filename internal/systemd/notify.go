@@ -0,0 +1,173 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+var log = logging.Component("systemd")
+
+// Notifier sends service state notifications to systemd, see sd_notify(3); a Notifier for a
+// process not started by systemd does nothing
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// NewNotifier returns a notifier for the socket and watchdog systemd passed to this process
+func NewNotifier() *Notifier {
+	return newNotifier(os.Getenv, os.Getpid())
+}
+
+func newNotifier(getenv func(string) string, pid int) *Notifier {
+	n := &Notifier{socket: getenv("NOTIFY_SOCKET")}
+	// the watchdog applies to the main process only, which may not be this one
+	if wpid := getenv("WATCHDOG_PID"); len(wpid) > 0 && wpid != strconv.Itoa(pid) {
+		return n
+	}
+	if usec, err := strconv.ParseInt(getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// Enabled reports whether this process was started by systemd with a notify socket
+func (n *Notifier) Enabled() bool {
+	return len(n.socket) > 0
+}
+
+// Watchdog returns how often systemd expects a WATCHDOG=1 notification, zero when it doesn't
+func (n *Notifier) Watchdog() time.Duration {
+	return n.watchdog
+}
+
+// Notify sends the given state assignments, i.e. READY=1, to systemd
+func (n *Notifier) Notify(state ...string) error {
+	if !n.Enabled() {
+		return nil
+	}
+	// sockets in the abstract namespace are given as @name, which net translates for us
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("unable to reach systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	msg := ""
+	for _, s := range state {
+		msg += s + "\n"
+	}
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("unable to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// Ready tells systemd the service has started
+func (n *Notifier) Ready(status string) error {
+	return n.Notify("READY=1", "STATUS="+status)
+}
+
+// Status updates the status shown by systemctl status
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// Alive pets the watchdog
+func (n *Notifier) Alive() error {
+	return n.Notify("WATCHDOG=1")
+}
+
+// Stopping tells systemd the service is shutting down
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// Service is what Run reports to systemd
+type Service struct {
+	// Ready is closed once the service is up; READY=1 isn't sent before then, so units that depend
+	// on the service wait for it
+	Ready <-chan struct{}
+	// Progress returns when the service last made progress; the watchdog isn't petted once that's
+	// more than an interval and a watchdog period ago, so systemd restarts a service that's stuck
+	Progress func() time.Time
+	// Status describes the service for systemctl status
+	Status func() string
+}
+
+// Run tells systemd when the service is ready and, until ctx is cancelled, updates its status every
+// interval; the watchdog is petted twice per watchdog period on its own, so a status func that's slow
+// to answer doesn't get the service killed, but only while the service makes progress
+func (n *Notifier) Run(ctx context.Context, interval time.Duration, svc Service) {
+	if !n.Enabled() {
+		return
+	}
+	if n.watchdog > 0 {
+		go n.petWatchdog(ctx, interval, svc.Progress)
+	}
+	ready := svc.Ready
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			if err := n.Stopping(); err != nil {
+				log.Error(err, "systemd notification failed")
+			}
+			return
+		case <-ready:
+			// a closed channel is always ready so it's only waited on once
+			ready = nil
+			err = n.Ready(svc.Status())
+		case <-ticker.C:
+			err = n.Status(svc.Status())
+		}
+		if err != nil {
+			log.Error(err, "systemd notification failed")
+		}
+	}
+}
+
+// petWatchdog pets the watchdog twice per watchdog period, for as long as the service makes progress,
+// until ctx is cancelled
+func (n *Notifier) petWatchdog(ctx context.Context, interval time.Duration, progress func() time.Time) {
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if last := progress(); time.Since(last) > interval+n.watchdog {
+				log.Warning("service is stuck, leaving the watchdog to restart it", "lastProgress", last.Format(time.RFC3339))
+				continue
+			}
+			if err := n.Alive(); err != nil {
+				log.Error(err, "systemd watchdog notification failed")
+			}
+		}
+	}
+}
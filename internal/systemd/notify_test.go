@@ -0,0 +1,156 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type env map[string]string
+
+func (e env) get(name string) string {
+	return e[name]
+}
+
+// fakeSystemd listens on a notify socket like systemd does
+func fakeSystemd(t *testing.T) (*net.UnixConn, string) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn, path := fakeSystemd(t)
+	n := newNotifier(env{"NOTIFY_SOCKET": path, "WATCHDOG_USEC": "90000000", "WATCHDOG_PID": "42"}.get, 42)
+	require.True(t, n.Enabled())
+	require.Equal(t, 90*time.Second, n.Watchdog())
+
+	require.NoError(t, n.Ready("connecting"))
+	require.Equal(t, "READY=1\nSTATUS=connecting\n", receive(t, conn))
+	require.NoError(t, n.Alive())
+	require.Equal(t, "WATCHDOG=1\n", receive(t, conn))
+}
+
+func TestNotifierWatchdogForAnotherProcess(t *testing.T) {
+	n := newNotifier(env{"NOTIFY_SOCKET": "/nonexistent", "WATCHDOG_USEC": "90000000", "WATCHDOG_PID": "1"}.get, 42)
+	require.Zero(t, n.Watchdog())
+}
+
+func TestNotifierWithoutSystemd(t *testing.T) {
+	n := newNotifier(env{}.get, 42)
+	require.False(t, n.Enabled())
+	require.NoError(t, n.Ready("ok"))
+}
+
+// service is a systemd.Service whose progress is set by the test
+type service struct {
+	lock     sync.Mutex
+	progress time.Time
+	checks   int
+}
+
+func (s *service) setProgress(t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.progress = t
+}
+
+func (s *service) Service(ready <-chan struct{}) Service {
+	return Service{
+		Ready: ready,
+		Progress: func() time.Time {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			return s.progress
+		},
+		Status: func() string {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.checks++
+			return fmt.Sprintf("check %d", s.checks)
+		},
+	}
+}
+
+func TestNotifierRun(t *testing.T) {
+	conn, path := fakeSystemd(t)
+	n := newNotifier(env{"NOTIFY_SOCKET": path, "WATCHDOG_USEC": "20000"}.get, 42)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ready := make(chan struct{})
+	svc := &service{progress: time.Now()}
+	go func() {
+		defer close(done)
+		n.Run(ctx, time.Hour, svc.Service(ready))
+	}()
+	// the watchdog is petted while the service starts, but it isn't ready until it says so
+	require.Equal(t, "WATCHDOG=1\n", receive(t, conn))
+	close(ready)
+	for {
+		if msg := receive(t, conn); msg != "WATCHDOG=1\n" {
+			require.Equal(t, "READY=1\nSTATUS=check 1\n", msg)
+			break
+		}
+	}
+	cancel()
+	<-done
+	for {
+		if msg := receive(t, conn); msg == "STOPPING=1\n" {
+			break
+		}
+	}
+}
+
+func TestNotifierRunStuck(t *testing.T) {
+	conn, path := fakeSystemd(t)
+	n := newNotifier(env{"NOTIFY_SOCKET": path, "WATCHDOG_USEC": "20000"}.get, 42)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// i.e. a check that's been busy re-registering with PIA for longer than the watchdog allows
+	svc := &service{progress: time.Now().Add(-time.Minute)}
+	go n.Run(ctx, 5*time.Millisecond, svc.Service(nil))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, fmt.Sprintf("STATUS=check %d\n", i+1), receive(t, conn))
+	}
+
+	// petting resumes once the service makes progress again
+	svc.setProgress(time.Now().Add(time.Hour))
+	for {
+		if msg := receive(t, conn); msg == "WATCHDOG=1\n" {
+			break
+		}
+	}
+}
@@ -18,61 +18,198 @@
 package os
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+var log = logging.Component("pinger")
+
+// DefaultTimeout is the default amount of time allowed to probe a single host
+const DefaultTimeout = 5000 * time.Millisecond
+
+// sampleTimeout returns how long a single sample of a probe may take: an even share of the time left
+// to probe, so a reply that never comes costs one sample rather than the whole probe
+func sampleTimeout(ctx context.Context, samples uint8) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok || samples == 0 {
+		return DefaultTimeout
+	}
+	return time.Until(deadline) / time.Duration(samples)
+}
+
 type Pinger interface {
-	Ping(host string, samples uint8) (avgDuration uint16, err error)
+	Ping(ctx context.Context, host string, samples uint8) PingResult
+}
+
+// PingResult holds the latency statistics of a probe; Err is set when the host could not be reached
+type PingResult struct {
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Jitter   time.Duration // standard deviation of the samples
+	Sent     int
+	Received int
+	Err      error
+}
+
+// Loss returns the fraction of samples that received no reply
+func (r PingResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+func (r PingResult) Reachable() bool {
+	return r.Err == nil && r.Received > 0
 }
 
 type abstractPinger struct {
-	pinger Pinger
+	pinger  Pinger
+	timeout time.Duration
+}
+
+// NewPinger returns a Pinger that uses the system ping command; timeout bounds the time
+// spent probing a single host
+func NewPinger(timeout time.Duration) Pinger {
+	return abstractPinger{
+		pinger:  pingerImpl{},
+		timeout: timeout,
+	}
 }
 
-func NewPinger() Pinger {
+// NewTcpPinger returns a Pinger that times TCP connections to the given port
+func NewTcpPinger(port uint16, timeout time.Duration) Pinger {
 	return abstractPinger{
-		pinger: pingerImpl{},
+		pinger: tcpPinger{
+			port: port,
+		},
+		timeout: timeout,
 	}
 }
 
-func (p abstractPinger) Ping(host string, samples uint8) (uint16, error) {
-	ping, err := p.pinger.Ping(host, samples)
-	if err != nil {
-		return 9999, fmt.Errorf("ping failed: %w", err)
-	} else if ping == 0 {
-		ping = 1
+// NewWgPinger returns a Pinger that times WireGuard handshakes with a server on the given port;
+// clientKey must already be registered with the server being probed
+func NewWgPinger(port uint16, timeout time.Duration, serverKey wgtypes.Key, clientKey wgtypes.Key) Pinger {
+	return abstractPinger{
+		pinger: wgPinger{
+			port:      port,
+			serverKey: serverKey,
+			clientKey: clientKey,
+		},
+		timeout: timeout,
 	}
-	return ping, err
 }
 
-func parsePingTimeUnix(output string) (uint16, error) {
-	var err error
-	var ping uint16
-	re := regexp.MustCompile(`= \d+(?:\.\d+)?\/(\d+)(?:\.\d+)?\/.+ ms`)
+func (p abstractPinger) Ping(ctx context.Context, host string, samples uint8) PingResult {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result := p.pinger.Ping(ctx, host, samples)
+	if result.Err == nil && result.Received == 0 {
+		result.Err = fmt.Errorf("no replies received")
+	}
+	if result.Err != nil {
+		result.Err = fmt.Errorf("ping failed: %w", result.Err)
+	}
+	log.ForContext(ctx).V(4).Info("probe finished", "host", host, logging.KeyDuration, time.Since(start),
+		"avg", result.Avg, "loss", result.Loss(), logging.KeyError, result.Err)
+	return result
+}
+
+// newPingResult computes the latency statistics of the given round trip samples
+func newPingResult(sent int, rtts []time.Duration) PingResult {
+	result := PingResult{
+		Sent:     sent,
+		Received: len(rtts),
+	}
+	if len(rtts) == 0 {
+		return result
+	}
+	var total time.Duration
+	result.Min = rtts[0]
+	for _, rtt := range rtts {
+		total += rtt
+		if rtt < result.Min {
+			result.Min = rtt
+		}
+		if rtt > result.Max {
+			result.Max = rtt
+		}
+	}
+	result.Avg = total / time.Duration(len(rtts))
+	var variance float64
+	for _, rtt := range rtts {
+		delta := float64(rtt - result.Avg)
+		variance += delta * delta
+	}
+	result.Jitter = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return result
+}
+
+func parsePingTimeUnix(output string) PingResult {
+	result, err := parsePingCounts(output, `(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	if err != nil || result.Received == 0 {
+		result.Err = err
+		return result
+	}
+	// busybox ping reports min/avg/max only, leaving the jitter unset
+	re := regexp.MustCompile(`= (\d+(?:\.\d+)?)\/(\d+(?:\.\d+)?)\/(\d+(?:\.\d+)?)(?:\/(\d+(?:\.\d+)?))? ms`)
 	matches := re.FindStringSubmatch(output)
-	if len(matches) > 1 {
-		var val uint64
-		val, err = strconv.ParseUint(matches[1], 10, 16)
-		ping = uint16(val)
-	} else {
-		err = fmt.Errorf("unable to find ping timings in output [unix]")
-	}
-	return ping, err
+	if len(matches) < 5 {
+		result.Err = fmt.Errorf("unable to find ping timings in output [unix]")
+		return result
+	}
+	// the regex guarantees these parse
+	result.Min = parseMillis(matches[1])
+	result.Avg = parseMillis(matches[2])
+	result.Max = parseMillis(matches[3])
+	if len(matches[4]) > 0 {
+		result.Jitter = parseMillis(matches[4])
+	}
+	return result
 }
 
-func parsePingTimeWindows(output string) (uint16, error) {
-	var err error
-	var ping uint16
-	re := regexp.MustCompile(`Average = (\d+)ms`)
+func parsePingTimeWindows(output string) PingResult {
+	result, err := parsePingCounts(output, `Sent = (\d+), Received = (\d+)`)
+	if err != nil || result.Received == 0 {
+		result.Err = err
+		return result
+	}
+	// windows does not report the deviation of the samples so jitter is left unset
+	re := regexp.MustCompile(`Minimum = (\d+)ms, Maximum = (\d+)ms, Average = (\d+)ms`)
 	matches := re.FindStringSubmatch(output)
-	if len(matches) > 1 {
-		var val uint64
-		val, err = strconv.ParseUint(matches[1], 10, 16)
-		ping = uint16(val)
-	} else {
-		err = fmt.Errorf("unable to find ping timings in output [windows]")
-	}
-	return ping, err
+	if len(matches) < 4 {
+		result.Err = fmt.Errorf("unable to find ping timings in output [windows]")
+		return result
+	}
+	result.Min = parseMillis(matches[1])
+	result.Max = parseMillis(matches[2])
+	result.Avg = parseMillis(matches[3])
+	return result
+}
+
+func parsePingCounts(output string, pattern string) (PingResult, error) {
+	matches := regexp.MustCompile(pattern).FindStringSubmatch(output)
+	if len(matches) < 3 {
+		return PingResult{}, fmt.Errorf("unable to find packet counts in output")
+	}
+	sent, _ := strconv.Atoi(matches[1])
+	received, _ := strconv.Atoi(matches[2])
+	return PingResult{Sent: sent, Received: received}, nil
+}
+
+func parseMillis(val string) time.Duration {
+	ms, _ := strconv.ParseFloat(val, 64)
+	return time.Duration(ms * float64(time.Millisecond))
 }
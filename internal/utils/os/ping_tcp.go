@@ -0,0 +1,62 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package os
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+)
+
+// tcpPinger measures the time it takes to complete a TCP handshake with the target;
+// useful on networks where ICMP is blocked
+type tcpPinger struct {
+	port uint16
+}
+
+func (p tcpPinger) Ping(ctx context.Context, host string, samples uint8) PingResult {
+	addr := net.JoinHostPort(host, fmt.Sprint(p.port))
+	dialer := net.Dialer{}
+	timeout := sampleTimeout(ctx, samples)
+	var rtts []time.Duration
+	var lastErr error
+	for i := uint8(0); i < samples && ctx.Err() == nil; i++ {
+		start := time.Now()
+		sampleCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := dialer.DialContext(sampleCtx, "tcp", addr)
+		cancel()
+		if err != nil {
+			log.ForContext(ctx).V(4).Info("tcp probe failed", "addr", addr, logging.KeyError, err)
+			lastErr = err
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+		conn.Close()
+	}
+	result := newPingResult(int(samples), rtts)
+	if result.Received == 0 {
+		result.Err = lastErr
+		if ctx.Err() != nil {
+			result.Err = ctx.Err()
+		}
+	}
+	return result
+}
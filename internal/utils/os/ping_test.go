@@ -18,78 +18,95 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package os
 
 import (
+	"bytes"
+	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type ping struct {
-	duration uint16
-	err      error
+	result PingResult
 }
 
-func (p ping) Ping(string, uint8) (uint16, error) {
-	return p.duration, p.err
+func (p ping) Ping(context.Context, string, uint8) PingResult {
+	return p.result
 }
 
-func newPinger(duration uint16, err error) abstractPinger {
+func newPinger(result PingResult) abstractPinger {
 	return abstractPinger{
 		pinger: ping{
-			duration: duration,
-			err:      err,
+			result: result,
 		},
 	}
 }
 
 func TestPingInterpretations(t *testing.T) {
 	var tests = []struct {
-		input    uint16
-		expected uint16
+		input     PingResult
+		reachable bool
+		loss      float64
 	}{
-		{0, 1}, // pings <1ms are rounded up to 1ms
-		{1, 1},
-		{2, 2},
-		{10, 10},
-		{100, 100},
-		{500, 500},
-		{10000, 10000},
+		{PingResult{Sent: 3, Received: 3, Avg: time.Millisecond}, true, 0},
+		{PingResult{Sent: 4, Received: 3, Avg: time.Millisecond}, true, 0.25},
+		{PingResult{Sent: 3, Received: 0}, false, 1}, // no replies is unreachable, not an error free zero latency
+		{PingResult{Sent: 0, Received: 0}, false, 1},
 	}
 	for i, tc := range tests {
-		p := newPinger(tc.input, nil)
-		d, err := p.Ping("foo", 1)
-		if err != nil || d != tc.expected {
-			t.Errorf("itr %d: expect %d, received %d", i, tc.expected, d)
+		r := newPinger(tc.input).Ping(context.Background(), "foo", 1)
+		if r.Reachable() != tc.reachable || r.Loss() != tc.loss {
+			t.Errorf("itr %d: expect reachable=%t loss=%f, received %+v", i, tc.reachable, tc.loss, r)
 		}
 	}
 }
 
 func TestFailedPing(t *testing.T) {
-	_, err := newPinger(0, errors.Errorf("oops")).Ping("foo", 1)
-	if err == nil || err.Error()[0:12] != "ping failed:" {
+	r := newPinger(PingResult{Sent: 1, Err: errors.Errorf("oops")}).Ping(context.Background(), "foo", 1)
+	if r.Err == nil || r.Err.Error()[0:12] != "ping failed:" {
 		t.Errorf("did not receive expected error response")
 	}
 }
 
+func TestPingResultStats(t *testing.T) {
+	ms := time.Millisecond
+	r := newPingResult(8, []time.Duration{2 * ms, 4 * ms, 4 * ms, 4 * ms, 5 * ms, 5 * ms, 7 * ms, 9 * ms})
+	require.Equal(t, 2*ms, r.Min)
+	require.Equal(t, 5*ms, r.Avg)
+	require.Equal(t, 9*ms, r.Max)
+	require.Equal(t, 2*ms, r.Jitter)
+}
+
 func TestUnixPingParse(t *testing.T) {
 	var tests = []struct {
 		input    string
-		expected uint16
+		expected PingResult
 	}{
-		{"rtt min/avg/max/mdev = 9.617/9.909/10.584/0.344 ms", 9},
-		{"rtt min/avg/max/mdev = 0.617/0.909/4.584/0.344 ms", 0},
-		{"rtt min/avg/max/mdev = 0.617/1.909/4.584/1.344 ms", 1},
-		{"rtt min/avg/max/mdev = 0.617/15.909/4.584/0.344 ms", 15},
-		{"rtt min/avg/max/mdev = 0.617/232.909/4.584/0.344 ms", 232},
-		{"rtt min/avg/max/mdev = 0.617/1000.909/4.584/0.344 ms", 1000},
+		{"3 packets transmitted, 3 received, 0% packet loss, time 2003ms\nrtt min/avg/max/mdev = 9.617/9.909/10.584/0.344 ms",
+			PingResult{Sent: 3, Received: 3, Min: 9617 * time.Microsecond, Avg: 9909 * time.Microsecond, Max: 10584 * time.Microsecond, Jitter: 344 * time.Microsecond}},
+		{"3 packets transmitted, 2 received, 33% packet loss, time 2003ms\nrtt min/avg/max/mdev = 1/2/3/1 ms",
+			PingResult{Sent: 3, Received: 2, Min: time.Millisecond, Avg: 2 * time.Millisecond, Max: 3 * time.Millisecond, Jitter: time.Millisecond}},
+		{"3 packets transmitted, 3 packets received, 0.0% packet loss\nround-trip min/avg/max/stddev = 0.617/1000.909/4.584/0.344 ms",
+			PingResult{Sent: 3, Received: 3, Min: 617 * time.Microsecond, Avg: 1000909 * time.Microsecond, Max: 4584 * time.Microsecond, Jitter: 344 * time.Microsecond}},
+		{"3 packets transmitted, 3 packets received, 0% packet loss\nround-trip min/avg/max = 20.150/20.561/21.117 ms",
+			PingResult{Sent: 3, Received: 3, Min: 20150 * time.Microsecond, Avg: 20561 * time.Microsecond, Max: 21117 * time.Microsecond}},
+		{"3 packets transmitted, 0 received, 100% packet loss, time 2040ms",
+			PingResult{Sent: 3, Received: 0}},
 	}
 
 	for i, tc := range tests {
-		result, err := parsePingTimeUnix(tc.input)
-		if err != nil {
-			t.Errorf("unexpected error [itr=%d]: %s", i, err.Error())
+		result := parsePingTimeUnix(tc.input)
+		if result.Err != nil {
+			t.Errorf("unexpected error [itr=%d]: %s", i, result.Err.Error())
 		}
 		if result != tc.expected {
-			t.Errorf("expected %d, got %d [itr=%d]", tc.expected, result, i)
+			t.Errorf("expected %+v, got %+v [itr=%d]", tc.expected, result, i)
 		}
 	}
 }
@@ -97,23 +114,168 @@ func TestUnixPingParse(t *testing.T) {
 func TestWindowsPingParse(t *testing.T) {
 	var tests = []struct {
 		input    string
-		expected uint16
+		expected PingResult
 	}{
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 9ms", 9},
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 0ms", 0},
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 1ms", 1},
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 15ms", 15},
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 232ms", 232},
-		{"    Minimum = 9ms, Maximum = 10ms, Average = 1000ms", 1000},
+		{"    Packets: Sent = 4, Received = 4, Lost = 0 (0% loss),\n    Minimum = 9ms, Maximum = 10ms, Average = 9ms",
+			PingResult{Sent: 4, Received: 4, Min: 9 * time.Millisecond, Avg: 9 * time.Millisecond, Max: 10 * time.Millisecond}},
+		{"    Packets: Sent = 4, Received = 3, Lost = 1 (25% loss),\n    Minimum = 0ms, Maximum = 1000ms, Average = 232ms",
+			PingResult{Sent: 4, Received: 3, Min: 0, Avg: 232 * time.Millisecond, Max: 1000 * time.Millisecond}},
+		{"    Packets: Sent = 4, Received = 0, Lost = 4 (100% loss),",
+			PingResult{Sent: 4, Received: 0}},
 	}
 
 	for i, tc := range tests {
-		result, err := parsePingTimeWindows(tc.input)
-		if err != nil {
-			t.Errorf("unexpected error [itr=%d]: %s", i, err.Error())
+		result := parsePingTimeWindows(tc.input)
+		if result.Err != nil {
+			t.Errorf("unexpected error [itr=%d]: %s", i, result.Err.Error())
 		}
 		if result != tc.expected {
-			t.Errorf("expected %d, got %d [itr=%d]", tc.expected, result, i)
+			t.Errorf("expected %+v, got %+v [itr=%d]", tc.expected, result, i)
+		}
+	}
+}
+
+func TestPingParseGarbage(t *testing.T) {
+	require.Error(t, parsePingTimeUnix("ping: unknown host foo").Err)
+	require.Error(t, parsePingTimeWindows("Ping request could not find host foo.").Err)
+}
+
+func TestTcpPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	r := NewTcpPinger(port, DefaultTimeout).Ping(context.Background(), "127.0.0.1", 3)
+	require.NoError(t, r.Err)
+	require.Equal(t, 3, r.Received)
+	require.True(t, r.Min <= r.Avg && r.Avg <= r.Max)
+}
+
+func TestTcpPingRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	r := NewTcpPinger(port, DefaultTimeout).Ping(context.Background(), "127.0.0.1", 2)
+	require.Error(t, r.Err)
+	require.False(t, r.Reachable())
+	require.Equal(t, float64(1), r.Loss())
+}
+
+// wgResponder answers handshake initiations that were built for serverKey by the
+// registered client key, except for the first drop of them; anything else is dropped like
+// a real wg server would
+func wgResponder(conn net.PacketConn, serverKey wgtypes.Key, clientKey wgtypes.Key, drop int) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if n != wgMsgInitiationSize || msg[0] != wgMsgInitiation {
+			continue
+		}
+		serverPub := serverKey.PublicKey()
+		mac1Key := wgHash([]byte(wgLabelMac1), serverPub[:])
+		mac, _ := blake2s.New128(mac1Key[:])
+		mac.Write(msg[:wgMsgInitiationMac1Off])
+		if !bytes.Equal(mac.Sum(nil), msg[wgMsgInitiationMac1Off:wgMsgInitiationMac1Off+16]) {
+			continue
+		}
+		chain := blake2s.Sum256([]byte(wgConstruction))
+		h := wgHash(chain[:], []byte(wgIdentifier))
+		h = wgHash(h[:], serverPub[:])
+		ephemeral := msg[8:40]
+		chain, _ = wgKdf2(chain[:], ephemeral)
+		h = wgHash(h[:], ephemeral)
+		ss, _ := curve25519.X25519(serverKey[:], ephemeral)
+		_, key := wgKdf2(chain[:], ss)
+		aead, _ := chacha20poly1305.New(key[:])
+		static, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg[40:88], h[:])
+		if err != nil || !bytes.Equal(static, clientKey[:]) {
+			continue
 		}
+		if drop > 0 {
+			drop--
+			continue
+		}
+		conn.WriteTo(make([]byte, 92), addr)
 	}
 }
+
+func TestWgPing(t *testing.T) {
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go wgResponder(conn, serverKey, clientKey.PublicKey(), 0)
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	r := NewWgPinger(port, DefaultTimeout, serverKey.PublicKey(), clientKey).Ping(context.Background(), "127.0.0.1", 2)
+	require.NoError(t, r.Err)
+	require.Equal(t, 2, r.Received)
+}
+
+func TestWgPingDroppedSample(t *testing.T) {
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go wgResponder(conn, serverKey, clientKey.PublicKey(), 1)
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	r := NewWgPinger(port, 1500*time.Millisecond, serverKey.PublicKey(), clientKey).Ping(context.Background(), "127.0.0.1", 3)
+	require.NoError(t, r.Err)
+	require.True(t, r.Reachable())
+	require.Equal(t, 2, r.Received)
+	require.InDelta(t, 1.0/3, r.Loss(), 0.001)
+}
+
+func TestWgPingUnregisteredKey(t *testing.T) {
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	otherKey, _ := wgtypes.GeneratePrivateKey()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go wgResponder(conn, serverKey, otherKey.PublicKey(), 0)
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	p := abstractPinger{
+		pinger: wgPinger{
+			port:      port,
+			serverKey: serverKey.PublicKey(),
+			clientKey: clientKey,
+		},
+		timeout: 200 * time.Millisecond,
+	}
+	r := p.Ping(context.Background(), "127.0.0.1", 1)
+	require.Error(t, r.Err)
+	require.False(t, r.Reachable())
+}
+
+func TestWgPingCancelled(t *testing.T) {
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	// nothing ever answers on this socket
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	r := NewWgPinger(port, time.Minute, serverKey.PublicKey(), clientKey).Ping(ctx, "127.0.0.1", 3)
+	require.True(t, time.Since(start) < 5*time.Second)
+	require.ErrorIs(t, r.Err, context.Canceled)
+	require.False(t, r.Reachable())
+}
@@ -23,33 +23,32 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
-	"k8s.io/klog/v2"
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
 )
 
 type pingerImpl struct{}
 
-func (p pingerImpl) Ping(host string, samples uint8) (uint16, error) {
-	// TODO ping timeout should be configurable
-	ctx, cancel := context.WithTimeout(context.Background(), 5000*time.Millisecond)
-	defer cancel()
+func (p pingerImpl) Ping(ctx context.Context, host string, samples uint8) PingResult {
 	cmdline := []string{"ping", "-c", fmt.Sprint(samples), host}
 	cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
+	start := time.Now()
 	out, err := cmd.CombinedOutput()
-	klog.V(4).Infof("Executing command line: %v [rc=%d]", cmdline, cmd.ProcessState.ExitCode())
-	klog.V(5).Infof("Output:\n%s", string(out))
-	var ping uint16
+	log := log.ForContext(ctx)
+	log.V(4).Info("ran ping", "cmdline", strings.Join(cmdline, " "), "rc", cmd.ProcessState.ExitCode(), logging.KeyDuration, time.Since(start))
+	log.V(5).Info("ping output:\n" + string(out))
 	if ctx.Err() != nil {
-		return ping, ctx.Err()
-	} else {
-		if err != nil {
-			if !klog.V(5).Enabled() {
-				klog.Errorf("Output:\n%s", string(out))
-			}
-			return ping, fmt.Errorf("ping failed: %w", err)
+		return PingResult{Sent: int(samples), Err: ctx.Err()}
+	}
+	result := parsePingTimeUnix(string(out))
+	// ping exits non-zero when no replies are received; the packet counts already report that
+	if err != nil && (result.Err != nil || result.Received > 0) {
+		if !log.V(5).Enabled() {
+			log.Error(err, "ping output:\n"+string(out))
 		}
-		ping, err = parsePingTimeUnix(string(out))
+		result.Err = fmt.Errorf("ping failed: %w", err)
 	}
-	return ping, err
+	return result
 }
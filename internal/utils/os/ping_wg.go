@@ -0,0 +1,213 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package os
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"time"
+
+	"gitlab.com/ddb_db/piawgcli/internal/logging"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// https://www.wireguard.com/protocol/
+const (
+	wgConstruction         = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier           = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMac1            = "mac1----"
+	wgMsgInitiation        = 1
+	wgMsgInitiationSize    = 148
+	wgMsgInitiationMac1Off = 116
+	// wg servers drop initiations from the same peer that arrive too close together
+	wgSampleInterval = 100 * time.Millisecond
+)
+
+// wgPinger measures the round trip of a WireGuard handshake initiation sent to the target;
+// the server only answers initiations from registered peers so the client key must have
+// been registered with the server (i.e. via addKey) before probing
+type wgPinger struct {
+	port      uint16
+	serverKey wgtypes.Key
+	clientKey wgtypes.Key
+}
+
+func (p wgPinger) Ping(ctx context.Context, host string, samples uint8) PingResult {
+	addr := net.JoinHostPort(host, fmt.Sprint(p.port))
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return PingResult{Sent: int(samples), Err: err}
+	}
+	defer conn.Close()
+	// unblock any pending read as soon as the probe is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	timeout := sampleTimeout(ctx, samples)
+	var rtts []time.Duration
+	var lastErr error
+	for i := uint8(0); i < samples && ctx.Err() == nil; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(wgSampleInterval):
+			case <-ctx.Done():
+				continue
+			}
+		}
+		rtt, err := p.sample(conn, timeout)
+		if err != nil {
+			log.ForContext(ctx).V(4).Info("wg probe failed", "addr", addr, logging.KeyError, err)
+			lastErr = err
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+	result := newPingResult(int(samples), rtts)
+	if result.Received == 0 {
+		result.Err = lastErr
+		if ctx.Err() != nil {
+			result.Err = ctx.Err()
+		}
+	}
+	return result
+}
+
+func (p wgPinger) sample(conn net.Conn, timeout time.Duration) (time.Duration, error) {
+	msg, err := newWgInitiation(p.clientKey, p.serverKey, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err = conn.Write(msg); err != nil {
+		return 0, err
+	}
+	if err = conn.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 256)
+	// any reply (handshake response or cookie reply) from the server is enough to time the round trip
+	if _, err = conn.Read(buf); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// newWgInitiation builds a handshake initiation message from the client to the server
+func newWgInitiation(clientKey wgtypes.Key, serverKey wgtypes.Key, now time.Time) ([]byte, error) {
+	ephemeral, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	clientPub := clientKey.PublicKey()
+	ephemeralPub := ephemeral.PublicKey()
+
+	chain := blake2s.Sum256([]byte(wgConstruction))
+	h := wgHash(chain[:], []byte(wgIdentifier))
+	h = wgHash(h[:], serverKey[:])
+
+	msg := make([]byte, wgMsgInitiationSize)
+	msg[0] = wgMsgInitiation
+	if _, err = rand.Read(msg[4:8]); err != nil {
+		return nil, err
+	}
+	copy(msg[8:40], ephemeralPub[:])
+
+	chain, _ = wgKdf2(chain[:], ephemeralPub[:])
+	h = wgHash(h[:], ephemeralPub[:])
+
+	ss, err := curve25519.X25519(ephemeral[:], serverKey[:])
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	chain, key = wgKdf2(chain[:], ss)
+	static := wgSeal(key, clientPub[:], h[:])
+	copy(msg[40:88], static)
+	h = wgHash(h[:], static)
+
+	ss, err = curve25519.X25519(clientKey[:], serverKey[:])
+	if err != nil {
+		return nil, err
+	}
+	_, key = wgKdf2(chain[:], ss)
+	timestamp := wgSeal(key, tai64n(now), h[:])
+	copy(msg[88:116], timestamp)
+
+	mac1Key := wgHash([]byte(wgLabelMac1), serverKey[:])
+	mac, _ := blake2s.New128(mac1Key[:])
+	mac.Write(msg[:wgMsgInitiationMac1Off])
+	copy(msg[wgMsgInitiationMac1Off:], mac.Sum(nil))
+	return msg, nil
+}
+
+func wgHash(a []byte, b []byte) [32]byte {
+	h, _ := blake2s.New256(nil)
+	h.Write(a)
+	h.Write(b)
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func wgHmac(key []byte, input ...[]byte) [32]byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, in := range input {
+		mac.Write(in)
+	}
+	var sum [32]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+func wgKdf2(key []byte, input []byte) ([32]byte, [32]byte) {
+	prk := wgHmac(key, input)
+	t1 := wgHmac(prk[:], []byte{0x1})
+	t2 := wgHmac(prk[:], t1[:], []byte{0x2})
+	return t1, t2
+}
+
+func wgSeal(key [32]byte, plaintext []byte, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(nil, nonce, plaintext, ad)
+}
+
+func tai64n(t time.Time) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[:8], uint64(0x400000000000000a+t.Unix()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+	return buf
+}
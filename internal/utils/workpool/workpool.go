@@ -0,0 +1,104 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package workpool
+
+import (
+	"context"
+	"sync"
+)
+
+// Job is a unit of work run by the pool
+type Job func(ctx context.Context) (interface{}, error)
+
+// Result is the outcome of the job at Index in the list of jobs given to the pool
+type Result struct {
+	Index int
+	Value interface{}
+	Err   error
+}
+
+// Pool runs jobs on a bounded number of workers
+type Pool struct {
+	workers int
+}
+
+func New(workers int) Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return Pool{
+		workers: workers,
+	}
+}
+
+// Run starts the jobs and streams their results, in the same order as the jobs were given,
+// as they become available; the channel is closed once every job has reported.  Once ctx is
+// done, jobs that have not yet started are not run and report ctx.Err() instead.
+func (p Pool) Run(ctx context.Context, jobs []Job) <-chan Result {
+	queue := make(chan int)
+	completed := make(chan Result)
+	go func() {
+		defer close(queue)
+		for i := range jobs {
+			queue <- i
+		}
+	}()
+	wg := sync.WaitGroup{}
+	for w := 0; w < p.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					completed <- Result{Index: i, Err: ctx.Err()}
+					continue
+				}
+				val, err := jobs[i](ctx)
+				completed <- Result{Index: i, Value: val, Err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(completed)
+	}()
+	return reorder(completed)
+}
+
+// reorder holds back results that complete out of order so they are delivered in job order
+func reorder(completed <-chan Result) <-chan Result {
+	ordered := make(chan Result)
+	go func() {
+		defer close(ordered)
+		pending := make(map[int]Result)
+		next := 0
+		for r := range completed {
+			pending[r.Index] = r
+			for {
+				it, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				ordered <- it
+				next++
+			}
+		}
+	}()
+	return ordered
+}
@@ -0,0 +1,97 @@
+/*
+piawgcli
+Copyright (C) 2021-2023  Derek Battams <derek@battams.ca>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package workpool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultsAreOrdered(t *testing.T) {
+	var jobs []Job
+	for i := 0; i < 20; i++ {
+		delay := time.Duration(20-i) * time.Millisecond
+		val := i
+		jobs = append(jobs, func(context.Context) (interface{}, error) {
+			// later jobs finish first
+			time.Sleep(delay)
+			return val, nil
+		})
+	}
+	var got []int
+	for r := range New(8).Run(context.Background(), jobs) {
+		require.NoError(t, r.Err)
+		require.Equal(t, r.Index, r.Value)
+		got = append(got, r.Index)
+	}
+	require.Len(t, got, 20)
+	for i, it := range got {
+		require.Equal(t, i, it)
+	}
+}
+
+func TestWorkersAreBounded(t *testing.T) {
+	var running, peak int32
+	var jobs []Job
+	for i := 0; i < 30; i++ {
+		jobs = append(jobs, func(context.Context) (interface{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil, nil
+		})
+	}
+	for range New(3).Run(context.Background(), jobs) {
+	}
+	require.True(t, peak <= 3, "peak workers: %d", peak)
+}
+
+func TestCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var started int32
+	var jobs []Job
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&started, 1)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	count := 0
+	for r := range New(2).Run(ctx, jobs) {
+		require.ErrorIs(t, r.Err, context.Canceled)
+		require.Equal(t, count, r.Index)
+		count++
+	}
+	require.True(t, time.Since(start) < 5*time.Second)
+	// every job reports but only those already running when cancelled were started
+	require.Equal(t, 10, count)
+	require.Equal(t, int32(2), atomic.LoadInt32(&started))
+}